@@ -3,7 +3,9 @@ package cali
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -17,44 +19,121 @@ import (
 const (
 	EXIT_CODE_RUNTIME_ERROR = 1
 	EXIT_CODE_API_ERROR     = 2
+	EXIT_CODE_INTERRUPTED   = 130
 
 	workdir = "/tmp/workspace"
 )
 
 var (
 	debug, jsonLogs, nonInteractive bool
-	dockerHost                      string
+	detach                          bool
+	dockerHost, cliName             string
+	cleanWorkspace                  string
 	myFlags                         *viper.Viper
 	gitCfg                          *GitCheckoutConfig
+	gitPushCfg                      *GitPushConfig
 )
 
+// configFlagsParsed is called by commands which parse flags outside of cobra's own parsing once they have,
+// so that the config file and profile they give take effect. It is set by Start
+var configFlagsParsed = func() {}
+
 // TaskFunc is a function executed by a Task when the command the Task belongs to is run
 type TaskFunc func(t *Task, args []string)
 
-// defaultTaskFunc is the TaskFunc which is executed unless a custom TaskFunc is
+// RunFunc is a function executed by a Task when the command the Task belongs to is run, which reports how
+// the run went rather than exiting on failure. The Result may be nil if no container was run
+type RunFunc func(t *Task, args []string) (*Result, error)
+
+// runFunc adapts a TaskFunc to a RunFunc
+func (f TaskFunc) runFunc() RunFunc {
+	return func(t *Task, args []string) (*Result, error) {
+		f(t, args)
+		return nil, nil
+	}
+}
+
+// defaultTaskFunc is the RunFunc which is executed unless a custom TaskFunc or RunFunc is
 // attached to the Task
-var defaultTaskFunc TaskFunc = func(t *Task, args []string) {
+var defaultTaskFunc RunFunc = func(t *Task, args []string) (*Result, error) {
+	if detach {
+		if gitPushCfg.Branch != "" {
+			return nil, fmt.Errorf("--git-push cannot be used with --detach, as the task finishes after %s exits", cliName)
+		}
+		// The checkouts could be refreshed while the task still runs, so it gets its own copies, which are
+		// data containers for stop --rm to remove
+		cfgs := []*GitCheckoutConfig{gitCfg}
+
+		if t.cmd != nil {
+			cfgs = append(cfgs, t.cmd.allRepos()...)
+		}
+
+		for _, cfg := range cfgs {
+			cfg.Snapshot = true
+			cfg.Native = false
+		}
+	}
+
+	// Anything temporary made for the task is removed when it finishes, including if SetDefaults fails part way
+	keep := false
+	defer func() {
+		if !keep {
+			t.Cleanup()
+		}
+	}()
+
 	if err := t.SetDefaults(args); err != nil {
-		log.Fatalf("Error setting container defaults: %s", err)
+		return nil, fmt.Errorf("Error setting container defaults: %s", err)
 	}
 	if err := t.InitDocker(); err != nil {
-		log.Fatalf("Error initialising Docker: %s", err)
+		return nil, fmt.Errorf("Error initialising Docker: %s", err)
+	}
+
+	if detach {
+		res, err := t.StartDetached("")
+
+		if err != nil {
+			return res, err
+		}
+		// Temporary containers are left for stop --rm to remove, as the container is still using them
+		keep = true
+		fmt.Println(res.ContainerID[:12])
+		return res, nil
+	}
+	res, err := t.RunContainer(false, "")
+
+	if err != nil {
+		return res, err
 	}
-	if _, err := t.StartContainer(false, ""); err != nil {
-		log.Fatalf("Error executing task: %s", err)
+
+	if err := t.PushToGit(gitPushCfg); err != nil {
+		return res, fmt.Errorf("Error pushing changes: %s", err)
 	}
+	return res, nil
 }
 
 // Task is the action performed when it's parent command is run
 type Task struct {
-	f, init TaskFunc
+	f    RunFunc
+	init TaskFunc
+	cmd  *command
+	// runsImage is set when the Task was given an image to run, which must not be empty
+	runsImage bool
 	*DockerClient
 }
 
 // SetFunc sets the TaskFunc which is run when the parent command is run
 // if this is left unset, the defaultTaskFunc will be executed instead
 func (t *Task) SetFunc(f TaskFunc) {
+	t.f = f.runFunc()
+	t.runsImage = false
+}
+
+// SetRunFunc sets the RunFunc which is run when the parent command is run. Any error it returns
+// is reported by Start, which exits with the container's exit code if it was an ExitError
+func (t *Task) SetRunFunc(f RunFunc) {
 	t.f = f
+	t.runsImage = false
 }
 
 // SetInitFunc sets the TaskFunc which is executed before the main TaskFunc. It's
@@ -68,9 +147,20 @@ func (t *Task) SetInitFunc(f TaskFunc) {
 // Mounts the PWD to /tmp/workspace
 // Mounts your ~/.aws directory to /root - change this if your image runs as a non-root user
 // Sets /tmp/workspace as the workdir
-// Configures git
+// Configures git, or copies the PWD into a clean workspace if requested
+// Mounts any additional repos declared on the command
+// Labels the container with the cli and command it was run by
 func (t *Task) SetDefaults(args []string) error {
 	t.SetWorkDir(workdir)
+
+	if t.Conf.Labels == nil {
+		t.Conf.Labels = make(map[string]string)
+	}
+	t.Conf.Labels[labelCli] = cliName
+
+	if t.cmd != nil {
+		t.Conf.Labels[labelCommand] = t.cmd.path()
+	}
 	awsDir, err := t.Bind("~/.aws", "/root/.aws")
 	if err != nil {
 		return err
@@ -78,6 +168,9 @@ func (t *Task) SetDefaults(args []string) error {
 	t.AddBinds([]string{awsDir})
 
 	err = t.BindFromGit(gitCfg, func() error {
+		if cleanWorkspace != "" {
+			return t.BindCleanWorkspace(".", cleanWorkspace)
+		}
 		pwd, err := t.Bind("./", workdir)
 		if err != nil {
 			return err
@@ -88,10 +181,30 @@ func (t *Task) SetDefaults(args []string) error {
 	if err != nil {
 		return err
 	}
+
+	if t.cmd != nil {
+		if err := t.BindReposFromGit(t.cmd.allRepos()); err != nil {
+			return err
+		}
+	}
 	t.SetCmd(args)
 	return nil
 }
 
+// inherit takes defaults from the Task of a parent command: its image, unless one is already set, and any envs,
+// binds and privileges it was given
+func (t *Task) inherit(parent *Task) {
+	if t.Conf.Image == "" {
+		t.SetImage(parent.Conf.Image)
+	}
+	t.SetEnvs(append(append([]string{}, parent.Conf.Env...), t.Conf.Env...))
+	t.SetBinds(append(append([]string{}, parent.HostConf.Binds...), t.HostConf.Binds...))
+
+	if parent.HostConf.Privileged {
+		t.Privileged(true)
+	}
+}
+
 // Bind is a utility function which will return the correctly formatted string when given a source
 // and destination directory
 //
@@ -103,7 +216,7 @@ func (t *Task) Bind(src, dst string) (string, error) {
 		usr, err := user.Current()
 
 		if err != nil {
-			return expanded, fmt.Errorf("Error expanding bind path: %s")
+			return expanded, fmt.Errorf("Error expanding bind path: %s", err)
 		}
 		expanded = filepath.Join(usr.HomeDir, src[2:])
 	} else {
@@ -112,20 +225,71 @@ func (t *Task) Bind(src, dst string) (string, error) {
 	expanded, err := filepath.Abs(expanded)
 
 	if err != nil {
-		return expanded, fmt.Errorf("Error expanding bind path: %s")
+		return expanded, fmt.Errorf("Error expanding bind path: %s", err)
 	}
 	return fmt.Sprintf("%s:%s", expanded, dst), nil
 }
 
+// AddMounts adds bind mounts given in the form src:dst, expanding src in the same way as Bind
+func (t *Task) AddMounts(mounts []string) error {
+	for _, m := range mounts {
+		parts := strings.SplitN(m, ":", 2)
+
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid mount %s, must be src:dst", m)
+		}
+		bnd, err := t.Bind(parts[0], parts[1])
+
+		if err != nil {
+			return err
+		}
+		t.AddBind(bnd)
+	}
+	return nil
+}
+
+// homeDir returns the home directory of the current user
+func homeDir() (string, error) {
+	usr, err := user.Current()
+
+	if err != nil {
+		return "", fmt.Errorf("Error finding home directory: %s", err)
+	}
+	return usr.HomeDir, nil
+}
+
+// dataDir returns a directory under ~/.<cli name> for cali to keep its own data in, creating it if needed
+func dataDir(elem ...string) (string, error) {
+	home, err := homeDir()
+
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(append([]string{home, "." + cliName}, elem...)...)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Error creating %s: %s", dir, err)
+	}
+	return dir, nil
+}
+
 // cobraFunc represents the function signiture which cobra uses for it's Run, PreRun, PostRun etc.
 type cobraFunc func(cmd *cobra.Command, args []string)
 
 // command is the actual command run by the cli and essentially just wraps cobra.Command and
 // has an associated Task
 type command struct {
-	name    string
-	RunTask *Task
-	cobra   *cobra.Command
+	name      string
+	RunTask   *Task
+	cobra     *cobra.Command
+	repos     []*GitCheckoutConfig
+	parent    *command
+	children  []*command
+	plugin    string
+	bindFlags bool
+
+	preHooks                []PreRunHook
+	postHooks, failureHooks []PostRunHook
 }
 
 // newCommand returns an freshly initialised command
@@ -158,36 +322,135 @@ func (c *command) setRun(f cobraFunc) {
 
 // Task is something executed by a command
 func (c *command) Task(def interface{}) *Task {
-	t := &Task{DockerClient: NewDockerClient()}
+	t := &Task{DockerClient: NewDockerClient(), cmd: c}
 
 	switch d := def.(type) {
 	case string:
 		t.SetImage(d)
-		t.SetFunc(defaultTaskFunc)
+		t.SetRunFunc(defaultTaskFunc)
+		t.runsImage = true
 	case TaskFunc:
 		t.SetFunc(d)
+	case RunFunc:
+		t.SetRunFunc(d)
 	default:
 		// Slightly unidiomatic to blow up here rather than return an error
 		// choosing to so as to keep the API uncluttered and also if you get here it's
 		// an implementation error rather than a runtime error.
-		fmt.Println("Unknown Task type. Must either be an image (string) or a TaskFunc")
+		fmt.Println("Unknown Task type. Must either be an image (string), a TaskFunc or a RunFunc")
 		os.Exit(EXIT_CODE_API_ERROR)
 	}
 	c.RunTask = t
 	return t
 }
 
+// Repo declares an additional git repo which is checked out into its own data container and mounted at
+// /tmp/workspace/<name> alongside the main workspace. An empty ref checks out master. The repo and ref can
+// be overridden with the --<name>-git and --<name>-git-ref flags
+//
+// When the workspace is $PWD rather than a --git checkout, Docker creates the mount point as an empty <name>
+// directory in $PWD, owned by root on Linux. Set MountPath on the returned config to mount the repo outside
+// the workspace instead
+func (c *command) Repo(name, repo, ref string) *GitCheckoutConfig {
+	cfg := &GitCheckoutConfig{
+		Branch:    "master",
+		Depth:     1,
+		MountPath: path.Join(workdir, name),
+	}
+	c.Flags().StringVar(&cfg.Repo, name+"-git", repo, fmt.Sprintf("Git repo to checkout at %s.", cfg.MountPath))
+	c.Flags().StringVar(&cfg.Ref, name+"-git-ref", ref, fmt.Sprintf("Branch, tag, commit SHA or ref of the %s repo to checkout.", name))
+	c.repos = append(c.repos, cfg)
+	return cfg
+}
+
+// Command returns a brand new command nested under this one, e.g. `cli aws login`. Nested commands inherit
+// the persistent flags of their parents. A command without a Task of its own runs its nearest parent's Task,
+// or shows help if there is none, and init funcs and task defaults of parent Tasks apply at every level
+func (c *command) Command(n string) *command {
+	cmd := newCommand(n)
+	cmd.parent = c
+	cmd.setPreRun(func(_ *cobra.Command, args []string) {
+		cmd.bindConfig()
+	})
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		t := cmd.task()
+
+		if t == nil {
+			return cc.Help()
+		}
+		// Errors from here on are not usage errors
+		cc.SilenceUsage = true
+		return cmd.runTask(t, args)
+	}
+	c.cobra.AddCommand(cmd.cobra)
+	c.children = append(c.children, cmd)
+	return cmd
+}
+
+// task returns the Task run by the command, which is its own or its nearest parent's
+func (c *command) task() *Task {
+	for cmd := c; cmd != nil; cmd = cmd.parent {
+		if cmd.RunTask != nil {
+			return cmd.RunTask
+		}
+	}
+	return nil
+}
+
+// lineage returns the command and its parents, outermost first
+func (c *command) lineage() []*command {
+	var cmds []*command
+
+	for cmd := c; cmd != nil; cmd = cmd.parent {
+		cmds = append([]*command{cmd}, cmds...)
+	}
+	return cmds
+}
+
+// initTask prepares the Task before it is run. Defaults are inherited from the Tasks of parent commands, then
+// the init funcs of every Task in the lineage are run, outermost first, and finally any overrides from config
+func (c *command) initTask(args []string) error {
+	t := c.task()
+
+	if t == nil {
+		return nil
+	}
+	t.cmd = c
+	lineage := c.lineage()
+
+	for _, cmd := range lineage {
+		if cmd.RunTask != nil && cmd.RunTask != t {
+			t.inherit(cmd.RunTask)
+		}
+	}
+
+	for _, cmd := range lineage {
+		if cmd.RunTask != nil && cmd.RunTask.init != nil {
+			cmd.RunTask.init(t, args)
+		}
+	}
+	return c.applyConfig(t)
+}
+
+// allRepos returns the additional repos declared on the command and its parents
+func (c *command) allRepos() []*GitCheckoutConfig {
+	var repos []*GitCheckoutConfig
+
+	for _, cmd := range c.lineage() {
+		repos = append(repos, cmd.repos...)
+	}
+	return repos
+}
+
 // Flags returns the FlagSet for the command and is used to set new flags for the command
 func (c *command) Flags() *flag.FlagSet {
 	return c.cobra.PersistentFlags()
 }
 
-// BindFlags needs to be called after all flags for a command have been defined
+// BindFlags needs to be called after all flags for a command have been defined. The flags are bound when the
+// command runs, so that their values can be read with FlagValues or set in the command's section of config
 func (c *command) BindFlags() {
-	c.Flags().VisitAll(func(f *flag.Flag) {
-		myFlags.BindPFlag(f.Name, f)
-		myFlags.SetDefault(f.Name, f.DefValue)
-	})
+	c.bindFlags = true
 }
 
 // commands is a set of commands
@@ -196,8 +459,18 @@ type commands map[string]*command
 // cli is the application itself
 type cli struct {
 	name    string
+	version string
 	cfgFile *string
 	cmds    commands
+	checks  []check
+	// configErrs are problems found reading config and command definitions, which stop every command but
+	// doctor, so that it can report them
+	configErrs []error
+	// commandsErr is the problem found reading the command definitions file, kept as config is read again
+	// when shell parses the config flags
+	commandsErr error
+	// notices are the messages about config already printed
+	notices map[string]bool
 	*command
 }
 
@@ -208,6 +481,8 @@ func Cli(n string) *cli {
 		cmds:    make(commands),
 		command: newCommand(n),
 	}
+	// Start reports errors itself
+	c.cobra.SilenceErrors = true
 	c.cobra.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		if debug {
 			log.SetLevel(log.DebugLevel)
@@ -216,22 +491,27 @@ func Cli(n string) *cli {
 		if jsonLogs {
 			log.SetFormatter(&log.JSONFormatter{})
 		}
+
+		if err := initTracing(); err != nil {
+			log.Warnf("Tracing disabled: %s", err)
+		}
+
+		if len(c.configErrs) > 0 && cmd.Annotations[annotationIgnoreConfigErrs] == "" {
+			for _, err := range c.configErrs {
+				fmt.Println(err)
+			}
+			os.Exit(EXIT_CODE_RUNTIME_ERROR)
+		}
 	}
 	myFlags = viper.New()
+	cliName = n
 	return &c
 }
 
 // Command returns a brand new command attached to it's parent cli
 func (c *cli) Command(n string) *command {
-	cmd := newCommand(n)
+	cmd := c.command.Command(n)
 	c.cmds[n] = cmd
-	cmd.setPreRun(func(c *cobra.Command, args []string) {
-		cmd.RunTask.init(cmd.RunTask, args)
-	})
-	cmd.setRun(func(c *cobra.Command, args []string) {
-		cmd.RunTask.f(cmd.RunTask, args)
-	})
-	c.cobra.AddCommand(cmd.cobra)
 	return cmd
 }
 
@@ -241,8 +521,11 @@ func (c *cli) FlagValues() *viper.Viper {
 	return myFlags
 }
 
-// initFlags does the intial setup of the root command's persistent flags
+// initFlags does the intial setup of the root command's persistent flags, if not already done
 func (c *cli) initFlags() {
+	if c.cfgFile != nil {
+		return
+	}
 	var cfg string
 	txt := fmt.Sprintf("config file (default is $HOME/.%s.yaml)", c.name)
 	c.cobra.PersistentFlags().StringVar(&cfg, "config", "", txt)
@@ -278,12 +561,73 @@ func (c *cli) initFlags() {
 	myFlags.BindPFlag("branch", c.Flags().Lookup("branch"))
 	myFlags.SetDefault("branch", "master")
 
+	c.Flags().StringVar(&gitCfg.Ref, "git-ref", "", "Tag, commit SHA or ref (e.g. refs/pull/123/head) to checkout. Overrides --git-branch.")
+	myFlags.BindPFlag("git-ref", c.Flags().Lookup("git-ref"))
+
+	txt = fmt.Sprintf("Checkout in process into a cache under ~/.%s/git rather than in a git data container. Falls back to a container if this fails.", c.name)
+	c.Flags().BoolVar(&gitCfg.Native, "git-native", false, txt)
+	myFlags.BindPFlag("git-native", c.Flags().Lookup("git-native"))
+	myFlags.SetDefault("git-native", false)
+
+	c.Flags().BoolVar(&gitCfg.Fresh, "git-fresh", false, "Recreate the git data container from scratch rather than refreshing it.")
+	myFlags.BindPFlag("git-fresh", c.Flags().Lookup("git-fresh"))
+
+	c.Flags().BoolVar(&gitCfg.Snapshot, "git-snapshot", false, "Give this run its own copy of the checkout so concurrent runs never see each other's changes.")
+	myFlags.BindPFlag("git-snapshot", c.Flags().Lookup("git-snapshot"))
+
+	gitPushCfg = new(GitPushConfig)
+	c.Flags().StringVar(&gitPushCfg.Branch, "git-push", "", "Commit any changes made to the --git checkout and push them to this branch.")
+	myFlags.BindPFlag("git-push", c.Flags().Lookup("git-push"))
+
+	c.Flags().StringVar(&gitPushCfg.Message, "git-push-message", "", "Commit message used by --git-push.")
+	myFlags.BindPFlag("git-push-message", c.Flags().Lookup("git-push-message"))
+
+	c.Flags().StringVar(&gitPushCfg.Author, "git-push-author", "", "Commit author used by --git-push, in the form \"Name <email>\".")
+	myFlags.BindPFlag("git-push-author", c.Flags().Lookup("git-push-author"))
+
+	c.Flags().BoolVar(&gitPushCfg.DryRun, "git-push-dry-run", false, "Print the changes --git-push would make rather than pushing them.")
+	myFlags.BindPFlag("git-push-dry-run", c.Flags().Lookup("git-push-dry-run"))
+
+	c.Flags().StringVar(&cleanWorkspace, "clean-workspace", "", "Copy the git repo at $PWD into a fresh volume rather than mounting it. Either head for only what is committed, or changes to include uncommitted changes.")
+	myFlags.BindPFlag("clean-workspace", c.Flags().Lookup("clean-workspace"))
+
 	c.Flags().StringVarP(&gitCfg.RelPath, "git-path", "P", "", "Path within a git repo where we want to operate.")
 	myFlags.BindPFlag("git-path", c.Flags().Lookup("git-path"))
+
+	c.Flags().BoolVar(&gitCfg.Submodules, "git-submodules", false, "Recursively checkout submodules.")
+	myFlags.BindPFlag("git-submodules", c.Flags().Lookup("git-submodules"))
+
+	c.Flags().BoolVar(&gitCfg.LFS, "git-lfs", false, "Fetch Git LFS objects.")
+	myFlags.BindPFlag("git-lfs", c.Flags().Lookup("git-lfs"))
+
+	c.Flags().IntVar(&gitCfg.Depth, "git-depth", 1, "Number of commits of history to fetch, -1 fetches the full history.")
+	myFlags.BindPFlag("git-depth", c.Flags().Lookup("git-depth"))
+	myFlags.SetDefault("git-depth", 1)
+
+	c.Flags().BoolVar(&gitCfg.Sparse, "git-sparse", false, "Only checkout the directory given by --git-path.")
+	myFlags.BindPFlag("git-sparse", c.Flags().Lookup("git-sparse"))
+
+	c.Flags().StringVar(&traceEndpoint, "trace-endpoint", "", "Export traces of each run over OTLP/HTTP to this URL, e.g. http://localhost:4318.")
+	myFlags.BindPFlag("trace-endpoint", c.Flags().Lookup("trace-endpoint"))
+
+	c.Flags().StringVar(&traceFile, "trace-file", "", "Append traces of each run to this file as JSON.")
+	myFlags.BindPFlag("trace-file", c.Flags().Lookup("trace-file"))
+
+	c.Flags().BoolVar(&detach, "detach", false, "Start the task container in the background and return immediately. See ps, logs, attach and stop.")
+	myFlags.BindPFlag("detach", c.Flags().Lookup("detach"))
+
+	txt = fmt.Sprintf("Layer this profile from the profiles section of config over the rest of it (default is $%s)", profileEnv(c.name))
+	c.Flags().StringVar(&configProfile, "config-profile", "", txt)
 }
 
-// initConfig does the initial setup of viper
+// initConfig does the initial setup of viper. It may be called again once shell has parsed the config flags
 func (c *cli) initConfig() {
+	c.configErrs = nil
+
+	if c.commandsErr != nil {
+		c.configErrs = append(c.configErrs, c.commandsErr)
+	}
+
 	if *c.cfgFile != "" {
 		myFlags.SetConfigFile(*c.cfgFile)
 	} else {
@@ -291,20 +635,99 @@ func (c *cli) initConfig() {
 		myFlags.AddConfigPath("$HOME")
 	}
 	myFlags.AutomaticEnv()
+	configLayers = nil
 
 	// If a config file is found, read it in
-	if err := myFlags.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", myFlags.ConfigFileUsed())
+	err := myFlags.ReadInConfig()
+
+	if err == nil {
+		c.notice("Using config file: " + myFlags.ConfigFileUsed())
+		addConfigLayer(myFlags.ConfigFileUsed())
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		c.configErrs = append(c.configErrs, fmt.Errorf("Error reading config file: %s", err))
+	}
+
+	// Project config takes precedence over the user's, and the profile over both
+	if err := c.mergeProjectConfig(); err != nil {
+		c.configErrs = append(c.configErrs, err)
+	}
+
+	if err := c.applyProfile(); err != nil {
+		c.configErrs = append(c.configErrs, err)
+	}
+
+	// Config can override the images of commands
+	if err := c.Validate(); err != nil {
+		c.configErrs = append(c.configErrs, err)
+	}
+}
+
+// readConfigFlags reads the config again if a config file or profile was given by flags, for commands which
+// parse their own flags after it was first read
+func (c *cli) readConfigFlags() {
+	if *c.cfgFile != "" || configProfile != "" {
+		c.initConfig()
+	}
+}
+
+// notice prints a message about the config to stderr, unless it has already been printed
+func (c *cli) notice(msg string) {
+	if c.notices == nil {
+		c.notices = make(map[string]bool)
+	}
+
+	if !c.notices[msg] {
+		fmt.Fprintln(os.Stderr, msg)
+		c.notices[msg] = true
 	}
 }
 
 // Start the fans please!
 func (c *cli) Start() {
 	c.initFlags()
+	c.addCompletion()
+	c.addDoctor()
+	c.addShell()
+	c.addDetachCommands()
+	c.addHistory()
+	c.addConfig()
+	c.recordHistory()
+
+	c.commandsErr = c.loadCommandsFile()
+	c.discoverPlugins()
+
+	if err := c.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(EXIT_CODE_API_ERROR)
+	}
 	cobra.OnInitialize(c.initConfig)
+	configFlagsParsed = c.readConfigFlags
 
-	if err := c.cobra.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(EXIT_CODE_RUNTIME_ERROR)
+	err := c.cobra.Execute()
+	shutdownTracing()
+
+	if err != nil {
+		// Plugins report their own errors, so only their exit code is passed on
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the code to exit with after err, which is the container's or plugin's if it exited with an
+// error
+func exitCode(err error) int {
+	if exitErr, ok := err.(*ExitError); ok {
+		return exitErr.Code
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+
+	if err == ErrInterrupted {
+		return EXIT_CODE_INTERRUPTED
 	}
+	return EXIT_CODE_RUNTIME_ERROR
 }
@@ -0,0 +1,155 @@
+package cali
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// CommandDefinition describes a command which runs an image, so that it can be loaded from a file rather
+// than written in Go. For example, in YAML:
+//
+//	commands:
+//	  terraform:
+//	    short: Run Terraform in an ephemeral container
+//	    image: hashicorp/terraform:0.9.9
+//	    flags:
+//	      - name: profile
+//	        shorthand: p
+//	        default: default
+//	        usage: Profile to use from the AWS shared credentials file
+//	        env: AWS_PROFILE
+//	    envs:
+//	      - TF_IN_AUTOMATION=true
+//	    mounts:
+//	      - ~/.ssh:/root/.ssh
+type CommandDefinition struct {
+	Short      string           `mapstructure:"short"`
+	Long       string           `mapstructure:"long"`
+	Image      string           `mapstructure:"image"`
+	Privileged bool             `mapstructure:"privileged"`
+	Envs       []string         `mapstructure:"envs"`
+	Mounts     []string         `mapstructure:"mounts"`
+	Flags      []FlagDefinition `mapstructure:"flags"`
+}
+
+// FlagDefinition describes a string flag of a CommandDefinition. If Env is set, the value of the flag is
+// passed to the container in that environment variable
+type FlagDefinition struct {
+	Name      string `mapstructure:"name"`
+	Shorthand string `mapstructure:"shorthand"`
+	Default   string `mapstructure:"default"`
+	Usage     string `mapstructure:"usage"`
+	Env       string `mapstructure:"env"`
+}
+
+// commandDefinitions is the layout of a file of command definitions
+type commandDefinitions struct {
+	Commands map[string]*CommandDefinition `mapstructure:"commands"`
+}
+
+// LoadCommands adds commands defined in data, which is in any format viper understands such as yaml or toml.
+// This is intended for definitions embedded in the binary. Commands already defined in Go take precedence
+func (c *cli) LoadCommands(data []byte, format string) error {
+	v := viper.New()
+	v.SetConfigType(format)
+
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("Error reading command definitions: %s", err)
+	}
+	return c.defineCommands(v)
+}
+
+// loadCommandsFile adds any commands defined in $HOME/.<cli name>-commands.yaml (or .toml, .json etc.)
+func (c *cli) loadCommandsFile() error {
+	v := viper.New()
+	v.SetConfigName(fmt.Sprintf(".%s-commands", c.name))
+	v.AddConfigPath("$HOME")
+
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("Error reading command definitions: %s", err)
+	}
+	log.Debugf("Using command definitions file: %s", v.ConfigFileUsed())
+	return c.defineCommands(v)
+}
+
+// defineCommands adds the commands defined in v
+func (c *cli) defineCommands(v *viper.Viper) error {
+	var defs commandDefinitions
+
+	if err := v.Unmarshal(&defs); err != nil {
+		return fmt.Errorf("Error decoding command definitions: %s", err)
+	}
+	names := make([]string, 0, len(defs.Commands))
+
+	for name := range defs.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if c.hasCommand(name) {
+			log.Debugf("Command %s is already defined, ignoring its definition", name)
+			continue
+		}
+
+		if err := c.defineCommand(name, defs.Commands[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defineCommand adds a command from its definition
+func (c *cli) defineCommand(name string, def *CommandDefinition) error {
+	if def == nil || def.Image == "" {
+		return fmt.Errorf("Command definition %s has no image", name)
+	}
+
+	for _, m := range def.Mounts {
+		if !strings.Contains(m, ":") {
+			return fmt.Errorf("Command definition %s has an invalid mount %s, must be src:dst", name, m)
+		}
+	}
+	cmd := c.Command(name)
+	cmd.SetShort(def.Short)
+	cmd.SetLong(def.Long)
+
+	for _, f := range def.Flags {
+		cmd.Flags().StringP(f.Name, f.Shorthand, f.Default, f.Usage)
+	}
+	cmd.BindFlags()
+
+	task := cmd.Task(def.Image)
+	task.SetInitFunc(func(t *Task, args []string) {
+		for _, f := range def.Flags {
+			if f.Env != "" {
+				t.AddEnv(f.Env, myFlags.GetString(f.Name))
+			}
+		}
+		t.AddEnvs(def.Envs)
+
+		if err := t.AddMounts(def.Mounts); err != nil {
+			log.Fatalf("Error adding mounts: %s", err)
+		}
+		t.Privileged(def.Privileged)
+	})
+	return nil
+}
+
+// hasCommand determines if a command called name has already been added
+func (c *cli) hasCommand(name string) bool {
+	for _, cmd := range c.cmds {
+		if cmd.cobra.Name() == name {
+			return true
+		}
+	}
+	return false
+}
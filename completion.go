@@ -0,0 +1,192 @@
+package cali
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/container"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+const (
+	// completionCacheTTL is how long completions from an image are cached for
+	completionCacheTTL = time.Hour
+	// completionTimeout is how long completing from an image may take, so that pressing tab never hangs
+	completionTimeout = 5 * time.Second
+)
+
+// CompletionFunc returns the completions for the next argument of a command, given the arguments so far and
+// the partial word being completed
+type CompletionFunc func(args []string, toComplete string) []string
+
+// SetCompletionFunc sets the function which completes the arguments of the command
+func (c *command) SetCompletionFunc(f CompletionFunc) {
+	c.cobra.ValidArgsFunction = func(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		comps := f(args, toComplete)
+
+		if len(comps) == 0 {
+			return nil, cobra.ShellCompDirectiveDefault
+		}
+		return comps, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// CompleteFromImage delegates completion of the command's arguments to the tool inside the image of its Task.
+// A short-lived container is run with cmd followed by the arguments so far and the partial word, and should
+// print one completion per line. COMP_LINE and COMP_POINT are also set, so tools which complete themselves
+// from those (such as terraform) need no cmd. The image is the one the command would run, after config and
+// init funcs are applied. Results are cached for an hour, and nothing is completed until the image has been
+// pulled, or if the container takes more than a few seconds, so that pressing tab never waits on a download
+func (c *command) CompleteFromImage(cmd ...string) {
+	c.SetCompletionFunc(func(args []string, toComplete string) []string {
+		// Flags are only parsed by cobra's completion command once the config has been read
+		configFlagsParsed()
+		image, err := c.completionImage(args)
+
+		if err != nil {
+			log.Debugf("Error completing from image: %s", err)
+			return nil
+		}
+
+		if image == "" {
+			return nil
+		}
+		comps, err := imageCompletions(image, c.cobra.Name(), cmd, args, toComplete)
+
+		if err != nil {
+			log.Debugf("Error completing from image: %s", err)
+			return nil
+		}
+		return comps
+	})
+}
+
+// completionImage prepares the command's Task as a run would, and returns its image, which is empty if it has
+// none
+func (c *command) completionImage(args []string) (string, error) {
+	c.bindConfig()
+
+	if err := c.initTask(args); err != nil {
+		return "", err
+	}
+
+	if t := c.task(); t != nil {
+		return t.Conf.Image, nil
+	}
+	return "", nil
+}
+
+// imageCompletions runs the completion command in image, or returns its cached output
+func imageCompletions(image, name string, cmd, args []string, toComplete string) ([]string, error) {
+	line := strings.Join(append(append([]string{name}, args...), toComplete), " ")
+	cache, err := dataDir("completion")
+
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%x", md5.Sum([]byte(image+"\x00"+strings.Join(cmd, " ")+"\x00"+line)))
+	path := filepath.Join(cache, key)
+
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < completionCacheTTL {
+		out, err := ioutil.ReadFile(path)
+
+		if err == nil {
+			return parseCompletions(string(out)), nil
+		}
+	}
+	cli := NewDockerClient()
+
+	if err := cli.InitDocker(); err != nil {
+		return nil, err
+	}
+
+	if !cli.ImageExists(image) {
+		return nil, fmt.Errorf("Image %s has not been pulled", image)
+	}
+	var run []string
+
+	if len(cmd) > 0 {
+		run = append(append(append(run, cmd...), args...), toComplete)
+	}
+	cli.SetConf(&container.Config{
+		Image: image,
+		Cmd:   run,
+		Env: []string{
+			"COMP_LINE=" + line,
+			"COMP_POINT=" + strconv.Itoa(len(line)),
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	out, err := cli.captureContainer(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path, []byte(out), 0600); err != nil {
+		log.Debugf("Error caching completions: %s", err)
+	}
+	return parseCompletions(out), nil
+}
+
+// parseCompletions splits completion output into its lines, dropping the directive line which cobra based
+// tools print last
+func parseCompletions(out string) []string {
+	var comps []string
+
+	for _, l := range strings.Split(out, "\n") {
+		l = strings.TrimSpace(l)
+
+		if l == "" || strings.HasPrefix(l, ":") {
+			continue
+		}
+		comps = append(comps, l)
+	}
+	return comps
+}
+
+// addCompletion adds the completion command, which prints a shell completion script
+func (c *cli) addCompletion() {
+	if c.hasCommand("completion") {
+		return
+	}
+	cmd := newCommand("completion")
+	cmd.cobra.Use = "completion [bash|zsh|fish]"
+	cmd.cobra.ValidArgs = []string{"bash", "zsh", "fish"}
+	cmd.cobra.Args = cobra.ExactValidArgs(1)
+	cmd.SetShort("Print a shell completion script")
+	cmd.SetLong(fmt.Sprintf(`Print a shell completion script. To load completions in the current shell:
+
+  bash: source <(%[1]s completion bash)
+  zsh:  source <(%[1]s completion zsh)
+  fish: %[1]s completion fish | source`, c.name))
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		cc.SilenceUsage = true
+		var err error
+
+		switch args[0] {
+		case "bash":
+			err = c.cobra.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			err = c.cobra.GenZshCompletion(os.Stdout)
+		case "fish":
+			err = c.cobra.GenFishCompletion(os.Stdout, true)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Error generating completion: %s", err)
+		}
+		return nil
+	}
+	c.cmds["completion"] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
@@ -0,0 +1,19 @@
+package cali
+
+import "testing"
+
+func TestCompletionImage(t *testing.T) {
+	c := Cli("test")
+	c.Command("terraform").Task("hashicorp/terraform:0.9.9")
+	plan := c.cmds["terraform"].Command("plan")
+	myFlags.Set("terraform.tag", "0.10.0")
+	image, err := plan.completionImage(nil)
+
+	if err != nil {
+		t.Fatalf("Failed to find image: %s", err)
+	}
+
+	if image != "hashicorp/terraform:0.10.0" {
+		t.Errorf("Completing from %s, want hashicorp/terraform:0.10.0 from config", image)
+	}
+}
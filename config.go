@@ -0,0 +1,435 @@
+package cali
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var configProfile string
+
+// configLayer is a file or profile merged into the config, kept to report where values came from
+type configLayer struct {
+	source string
+	v      *viper.Viper
+}
+
+// configLayers are the layers merged into the config, in order of precedence, lowest first
+var configLayers []configLayer
+
+// tagPattern matches a valid image tag
+var tagPattern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// addConfigLayer records the config file at path as a layer
+func addConfigLayer(path string) {
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	if err := v.ReadInConfig(); err != nil {
+		log.Debugf("Error reading config file %s: %s", path, err)
+		return
+	}
+	configLayers = append(configLayers, configLayer{source: path, v: v})
+}
+
+// profileEnv returns the environment variable which selects a profile when --config-profile is not given
+func profileEnv(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_PROFILE"
+}
+
+// selectedProfile returns the profile selected and how it was selected
+func (c *cli) selectedProfile() (name, from string) {
+	if configProfile != "" {
+		return configProfile, "--config-profile"
+	}
+	env := profileEnv(c.name)
+	return os.Getenv(env), "$" + env
+}
+
+// applyProfile layers the selected profile over the config files. A profile is a section of profiles holding
+// any config, so it can set flags, and the image, tag, envs and mounts of any command:
+//
+//	profiles:
+//	  prod:
+//	    terraform:
+//	      profile: production
+//	      tag: 0.10.0
+func (c *cli) applyProfile() error {
+	name, from := c.selectedProfile()
+
+	if name == "" {
+		return nil
+	}
+	sub := myFlags.Sub("profiles." + name)
+
+	if sub == nil {
+		return fmt.Errorf("Unknown config profile %s given by %s", name, from)
+	}
+	settings := sub.AllSettings()
+
+	if err := myFlags.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("Error merging config profile: %s", err)
+	}
+	v := viper.New()
+	v.MergeConfigMap(settings)
+	configLayers = append(configLayers, configLayer{source: "profile " + name, v: v})
+	c.notice("Using config profile: " + name)
+	return nil
+}
+
+// mergeProjectConfig layers the nearest .<cli name>.yaml (or .toml, .json etc.) found walking up from the
+// working directory over the config already read. This lets a repo pin the tools it uses, e.g. with
+// terraform.tag. A repo is not necessarily trusted, so anything other than image tags is ignored rather than
+// letting it choose the images, mounts and envs of the user's tasks
+func (c *cli) mergeProjectConfig() error {
+	path, err := findProjectConfig(c.name)
+
+	if err != nil || path == "" {
+		return err
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("Error reading project config file: %s", err)
+	}
+	pins := viper.New()
+
+	for _, key := range v.AllKeys() {
+		tag := v.GetString(key)
+
+		if !strings.HasSuffix(key, ".tag") || !tagPattern.MatchString(tag) {
+			log.Warnf("Ignoring %s in project config file %s, which can only pin image tags", key, path)
+			continue
+		}
+		pins.Set(key, tag)
+	}
+
+	if err := myFlags.MergeConfigMap(pins.AllSettings()); err != nil {
+		return fmt.Errorf("Error merging project config file: %s", err)
+	}
+	configLayers = append(configLayers, configLayer{source: path, v: pins})
+	c.notice("Using project config file: " + path)
+	return nil
+}
+
+// findProjectConfig returns the path of the nearest project config file, or an empty string if there is none.
+// The search stops at the root of the git repo containing the working directory, or else the home directory
+func findProjectConfig(name string) (string, error) {
+	dir, err := os.Getwd()
+
+	if err != nil {
+		return "", fmt.Errorf("Unable to get current working directory: %s", err)
+	}
+	home, _ := homeDir()
+
+	for ; dir != home; dir = filepath.Dir(dir) {
+		v := viper.New()
+		v.SetConfigName("." + name)
+		v.AddConfigPath(dir)
+
+		if err := v.ReadInConfig(); err == nil {
+			return v.ConfigFileUsed(), nil
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			break
+		}
+
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+	return "", nil
+}
+
+// bindConfig binds the flags of the command and its parents to the global viper just before the command runs,
+// so commands may define flags with the same name. A flag's value can also be set in the command's section of
+// the config file, e.g. terraform.profile, which takes precedence over an unscoped profile key. It is merged
+// into the config rather than set, so environment variables and flags still take precedence over it
+func (c *command) bindConfig() {
+	values := make(map[string]interface{})
+
+	for _, cmd := range c.lineage() {
+		if !cmd.bindFlags {
+			continue
+		}
+		cmd.Flags().VisitAll(func(f *flag.Flag) {
+			myFlags.BindPFlag(f.Name, f)
+			myFlags.SetDefault(f.Name, f.DefValue)
+			delete(values, f.Name)
+			key := cmd.configKey(f.Name)
+
+			if !f.Changed && myFlags.IsSet(key) {
+				values[f.Name] = myFlags.Get(key)
+			}
+		})
+	}
+
+	if len(values) > 0 {
+		myFlags.MergeConfigMap(values)
+	}
+}
+
+// applyConfig overrides the Task from the config sections of the command and its parents, outermost first.
+// Each section may set:
+//
+//	terraform:
+//	  image: hashicorp/terraform:0.10.0   # replaces the image
+//	  tag: 0.10.0                         # or just its tag
+//	  envs:
+//	    - TF_LOG=DEBUG
+//	  mounts:
+//	    - ~/.terraformrc:/root/.terraformrc
+func (c *command) applyConfig(t *Task) error {
+	for _, cmd := range c.lineage() {
+		if cmd.parent == nil {
+			continue
+		}
+
+		if img := myFlags.GetString(cmd.configKey("image")); img != "" {
+			t.SetImage(img)
+		}
+
+		if tag := myFlags.GetString(cmd.configKey("tag")); tag != "" {
+			t.SetImage(withTag(t.Conf.Image, tag))
+		}
+		t.AddEnvs(myFlags.GetStringSlice(cmd.configKey("envs")))
+
+		if err := t.AddMounts(myFlags.GetStringSlice(cmd.configKey("mounts"))); err != nil {
+			return fmt.Errorf("Error adding mounts from config: %s", err)
+		}
+	}
+	return nil
+}
+
+// configKey returns key scoped to the command's section of the config, e.g. aws.login.profile
+func (c *command) configKey(key string) string {
+	var path []string
+
+	for _, cmd := range c.lineage() {
+		if cmd.parent != nil {
+			path = append(path, cmd.cobra.Name())
+		}
+	}
+	return strings.Join(append(path, key), ".")
+}
+
+// withTag replaces the tag or digest of image with tag
+func withTag(image, tag string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + tag
+}
+
+// ConfigValue is a value in the effective config and where it came from
+type ConfigValue struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// configValues returns the effective config, excluding the profiles section, with keys under any of the
+// prefixes given. Flags of commands are included under their command's section, e.g. terraform.profile, as
+// they are only bound to the config when their command runs
+func (c *cli) configValues(prefixes []string) []ConfigValue {
+	var values []ConfigValue
+	flags := c.commandFlags()
+	keys := myFlags.AllKeys()
+	known := make(map[string]bool)
+
+	for _, key := range keys {
+		known[key] = true
+	}
+
+	for key := range flags {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, "profiles.") || !hasKeyPrefix(key, prefixes) {
+			continue
+		}
+		f := c.cobra.PersistentFlags().Lookup(key)
+
+		if f == nil {
+			f = flags[key]
+		}
+		v := ConfigValue{Key: key, Value: myFlags.Get(key), Source: configSource(key, f)}
+
+		// The flag's own value is used unless something else set the key, and viper's default for it may differ
+		if f != nil && (f.Changed || v.Source == "default") {
+			v.Value = flagValue(f)
+		}
+
+		if secretPattern.MatchString(key[strings.LastIndex(key, ".")+1:]) {
+			v.Value = redacted
+		} else {
+			v.Value = redactValue(v.Value)
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values
+}
+
+// commandFlags returns the flags of commands which bind them, by their key in the command's section of the
+// config, e.g. terraform.profile
+func (c *cli) commandFlags() map[string]*flag.Flag {
+	flags := make(map[string]*flag.Flag)
+	var visit func(cmds []*command)
+	visit = func(cmds []*command) {
+		for _, cmd := range cmds {
+			if cmd.bindFlags {
+				cmd.Flags().VisitAll(func(f *flag.Flag) {
+					flags[cmd.configKey(f.Name)] = f
+				})
+			}
+			visit(cmd.children)
+		}
+	}
+	visit(c.children)
+	return flags
+}
+
+// redactValue redacts secret looking KEY=value entries, such as those of envs, and credentials in URLs from a
+// config value
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactURLs(redactEnv(v))
+	case []string:
+		out := make([]string, len(v))
+
+		for i, s := range v {
+			out[i] = redactURLs(redactEnv(s))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+
+		for i, e := range v {
+			out[i] = redactValue(e)
+		}
+		return out
+	}
+	return value
+}
+
+// flagValue returns the value of f, typed as viper would return it for the common types of flag
+func flagValue(f *flag.Flag) interface{} {
+	s := f.Value.String()
+
+	switch f.Value.Type() {
+	case "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "int":
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+	}
+
+	if v, ok := f.Value.(flag.SliceValue); ok {
+		return v.GetSlice()
+	}
+	return s
+}
+
+// configSource returns where the effective value of key, which is set by the flag f if it is not nil, came
+// from, in viper's order of precedence
+func configSource(key string, f *flag.Flag) string {
+	if f != nil && f.Changed {
+		return "flag --" + f.Name
+	}
+
+	if _, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+		return "env $" + strings.ToUpper(key)
+	}
+
+	for i := len(configLayers) - 1; i >= 0; i-- {
+		if configLayers[i].v.IsSet(key) {
+			return configLayers[i].source
+		}
+	}
+	return "default"
+}
+
+// hasKeyPrefix returns whether key is, or is under, any of the prefixes. No prefixes matches every key
+func hasKeyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range prefixes {
+		p = strings.ToLower(p)
+
+		if key == p || strings.HasPrefix(key, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// addConfig adds the config command
+func (c *cli) addConfig() {
+	if c.hasCommand("config") {
+		return
+	}
+	var output string
+	cmd := newCommand("config [key...]")
+	cmd.SetShort("Show the effective config and where each value came from")
+	cmd.SetLong(`Show the effective config after layering the config file, the project config file, the profile,
+environment variables and flags, and where each value came from. Keys can be given to only show those, or those
+under them, e.g. terraform`)
+	cmd.cobra.Flags().StringVarP(&output, "output", "o", "text", "Output format, text or json")
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		if output != "text" && output != "json" {
+			return fmt.Errorf("Unknown output format %s, must be text or json", output)
+		}
+		cc.SilenceUsage = true
+		profile, from := c.selectedProfile()
+		values := c.configValues(args)
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(struct {
+				Profile string        `json:"profile,omitempty"`
+				Values  []ConfigValue `json:"values"`
+			}{profile, values})
+		}
+
+		if profile != "" {
+			fmt.Printf("Profile: %s (from %s)\n\n", profile, from)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+
+		for _, v := range values {
+			fmt.Fprintf(w, "%s\t%v\t%s\n", v.Key, v.Value, v.Source)
+		}
+		return w.Flush()
+	}
+	c.cmds["config"] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
@@ -0,0 +1,321 @@
+package cali
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Labels on task containers, so that detached ones can be found again
+	labelCli      = "cali.cli"
+	labelCommand  = "cali.command"
+	labelDetached = "cali.detached"
+	// labelTemporary marks git snapshots and clean workspaces, which are removed along with their task
+	labelTemporary = "cali.temporary"
+
+	// stopTimeout is how long a container has to stop before it is killed
+	stopTimeout = 10 * time.Second
+)
+
+// StartDetached will create and start a container in the background, returning a Result without waiting
+// for it to finish. Detached containers are listed by the ps command
+func (c *DockerClient) StartDetached(name string) (*Result, error) {
+	if c.Conf.Labels == nil {
+		c.Conf.Labels = make(map[string]string)
+	}
+	c.Conf.Labels[labelDetached] = "true"
+
+	if err := c.PullImage(c.Conf.Image); err != nil {
+		return nil, fmt.Errorf("Failed to fetch image: %s", err)
+	}
+	resp, err := c.Cli.ContainerCreate(context.Background(), c.Conf, c.HostConf, c.NetConf, name)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create container: %s", err)
+	}
+	res := &Result{
+		ContainerID: resp.ID,
+		Image:       c.Conf.Image,
+		ImageDigest: c.imageDigest(c.Conf.Image),
+	}
+
+	if err := c.Cli.ContainerStart(context.Background(), resp.ID, types.ContainerStartOptions{}); err != nil {
+		// Remove the container so that the temporary containers it would have used can be cleaned up
+		if rerr := c.Cli.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true}); rerr != nil {
+			log.Warnf("Failed to remove container %s: %s", resp.ID[:12], rerr)
+		}
+		return res, fmt.Errorf("Failed to start container: %s", err)
+	}
+	res.Started = time.Now()
+	return res, nil
+}
+
+// addDetachCommands adds the ps, logs, attach and stop commands for detached containers
+func (c *cli) addDetachCommands() {
+	var all, follow, rm bool
+
+	ps := newCommand("ps")
+	ps.SetShort("List containers started with --detach")
+	ps.cobra.Flags().BoolVarP(&all, "all", "a", false, "Include containers which have exited.")
+	ps.cobra.Args = cobra.NoArgs
+	ps.cobra.RunE = func(_ *cobra.Command, args []string) error {
+		return c.ps(all)
+	}
+
+	logs := newCommand("logs")
+	logs.cobra.Use = "logs <container>"
+	logs.SetShort("Print the logs of a container started with --detach")
+	logs.cobra.Flags().BoolVarP(&follow, "follow", "f", false, "Follow the logs until the container exits.")
+	logs.cobra.Args = cobra.ExactArgs(1)
+	logs.cobra.RunE = func(_ *cobra.Command, args []string) error {
+		return c.logs(args[0], follow)
+	}
+
+	attach := newCommand("attach")
+	attach.cobra.Use = "attach <container>"
+	attach.SetShort("Attach to a container started with --detach")
+	attach.SetLong("Attach to a container started with --detach. Press ctrl+p ctrl+q to detach again.")
+	attach.cobra.Args = cobra.ExactArgs(1)
+	attach.cobra.RunE = func(_ *cobra.Command, args []string) error {
+		return c.attach(args[0])
+	}
+
+	stop := newCommand("stop")
+	stop.cobra.Use = "stop <container>..."
+	stop.SetShort("Stop containers started with --detach")
+	stop.cobra.Flags().BoolVar(&rm, "rm", false, "Also remove the containers.")
+	stop.cobra.Args = cobra.MinimumNArgs(1)
+	stop.cobra.RunE = func(_ *cobra.Command, args []string) error {
+		return c.stop(args, rm)
+	}
+
+	for _, cmd := range []*command{ps, logs, attach, stop} {
+		if c.hasCommand(cmd.cobra.Name()) {
+			continue
+		}
+		cmd.cobra.SilenceUsage = true
+		c.cmds[cmd.cobra.Name()] = cmd
+		c.cobra.AddCommand(cmd.cobra)
+	}
+}
+
+// ps prints a table of detached containers
+func (c *cli) ps(all bool) error {
+	cli, err := detachedClient()
+
+	if err != nil {
+		return err
+	}
+	args := filters.NewArgs()
+	args.Add("label", labelCli+"="+c.name)
+	args.Add("label", labelDetached+"=true")
+	containers, err := cli.Cli.ContainerList(context.Background(), types.ContainerListOptions{All: all, Filters: args})
+
+	if err != nil {
+		return fmt.Errorf("Failed to list containers: %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMAND\tIMAGE\tSTATUS\tCREATED")
+
+	for _, ct := range containers {
+		created := time.Unix(ct.Created, 0).Format("2006-01-02 15:04:05")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ct.ID[:12], ct.Labels[labelCommand], ct.Image, ct.Status, created)
+	}
+	return w.Flush()
+}
+
+// logs prints the logs of a detached container
+func (c *cli) logs(id string, follow bool) error {
+	cli, err := detachedClient()
+
+	if err != nil {
+		return err
+	}
+	inspect, err := c.detachedContainer(cli, id)
+
+	if err != nil {
+		return err
+	}
+	opts := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: follow}
+	ls, err := cli.Cli.ContainerLogs(context.Background(), inspect.ID, opts)
+
+	if err != nil {
+		return fmt.Errorf("Failed to get container logs: %s", err)
+	}
+	defer ls.Close()
+
+	if inspect.Config.Tty {
+		_, err = io.Copy(os.Stdout, ls)
+	} else {
+		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, ls)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to get container logs: %s", err)
+	}
+	return nil
+}
+
+// attach connects the terminal to a detached container until it exits or is detached from
+func (c *cli) attach(id string) error {
+	cli, err := detachedClient()
+
+	if err != nil {
+		return err
+	}
+	inspect, err := c.detachedContainer(cli, id)
+
+	if err != nil {
+		return err
+	}
+
+	if !inspect.State.Running {
+		return fmt.Errorf("Container %s is not running", id)
+	}
+	opts := types.ContainerAttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true}
+	hijack, err := cli.Cli.ContainerAttach(context.Background(), inspect.ID, opts)
+
+	if err != nil {
+		return fmt.Errorf("Failed to attach to container: %s", err)
+	}
+	defer hijack.Close()
+	fd := int(os.Stdin.Fd())
+
+	if inspect.Config.Tty && terminal.IsTerminal(fd) {
+		oldState, err := terminal.MakeRaw(fd)
+
+		if err != nil {
+			return fmt.Errorf("Failed to set up terminal: %s", err)
+		}
+		defer terminal.Restore(fd, oldState)
+		tw, th, _ := terminal.GetSize(fd)
+		cli.Cli.ContainerResize(context.Background(), inspect.ID, types.ResizeOptions{Height: uint(th), Width: uint(tw)})
+	}
+
+	go func() {
+		io.Copy(hijack.Conn, os.Stdin)
+		hijack.CloseWrite()
+	}()
+
+	if inspect.Config.Tty {
+		_, err = io.Copy(os.Stdout, hijack.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, hijack.Reader)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to read from container: %s", err)
+	}
+	return nil
+}
+
+// stop stops detached containers, removing them if rm is set
+func (c *cli) stop(ids []string, rm bool) error {
+	cli, err := detachedClient()
+
+	if err != nil {
+		return err
+	}
+	var failed []string
+
+	for _, id := range ids {
+		if err := c.stopContainer(cli, id, rm); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// stopContainer stops a detached container, removing it if rm is set
+func (c *cli) stopContainer(cli *DockerClient, id string, rm bool) error {
+	inspect, err := c.detachedContainer(cli, id)
+
+	if err != nil {
+		return err
+	}
+	timeout := stopTimeout
+
+	if err := cli.Cli.ContainerStop(context.Background(), inspect.ID, &timeout); err != nil {
+		return fmt.Errorf("Failed to stop container %s: %s", id, err)
+	}
+
+	if !rm {
+		return nil
+	}
+
+	if err := cli.DeleteContainer(inspect.ID); err != nil {
+		return err
+	}
+	return removeTemporaryContainers(cli, inspect.HostConfig.VolumesFrom)
+}
+
+// removeTemporaryContainers removes the git snapshots and clean workspaces among the containers a task
+// container mounted the volumes of
+func removeTemporaryContainers(cli *DockerClient, volumesFrom []string) error {
+	for _, from := range volumesFrom {
+		id := strings.SplitN(from, ":", 2)[0]
+		inspect, err := cli.Cli.ContainerInspect(context.Background(), id)
+
+		if client.IsErrContainerNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to inspect Docker container: %s", err)
+		}
+
+		if inspect.Config.Labels[labelTemporary] != "true" {
+			continue
+		}
+		opts := types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}
+
+		if err := cli.Cli.ContainerRemove(context.Background(), inspect.ID, opts); err != nil {
+			return fmt.Errorf("Failed to remove container %s: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// detachedContainer inspects the container id, which may be a prefix of its ID or its name, checking it
+// was detached by this cli
+func (c *cli) detachedContainer(cli *DockerClient, id string) (types.ContainerJSON, error) {
+	inspect, err := cli.Cli.ContainerInspect(context.Background(), id)
+
+	if err != nil {
+		return inspect, fmt.Errorf("Failed to inspect Docker container: %s", err)
+	}
+
+	if inspect.Config.Labels[labelCli] != c.name || inspect.Config.Labels[labelDetached] != "true" {
+		return inspect, fmt.Errorf("Container %s was not started by %s --detach", id, c.name)
+	}
+	return inspect, nil
+}
+
+// detachedClient returns a Docker client for managing detached containers
+func detachedClient() (*DockerClient, error) {
+	cli := NewDockerClient()
+
+	if err := cli.InitDocker(); err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
@@ -2,23 +2,35 @@ package cali
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/net/context"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
+// dockerAPIVersion is the version of the Docker API used to talk to the daemon
+const dockerAPIVersion = "1.22"
+
+// containersRunning counts the calls to RunContainer in progress, which handle ctrl+c themselves
+var containersRunning int32
+
 // Event holds the json structure for Docker API events
 type Event struct {
 	Id     string `json:"id"`
@@ -45,7 +57,22 @@ type DockerClient struct {
 	HostConf *container.HostConfig
 	NetConf  *network.NetworkingConfig
 	Conf     *container.Config
+	// GitInfo describes the commit the task runs against, once resolved by BindFromGit
+	GitInfo  *GitInfo
+	checkout *gitCheckout
 	running  []string
+	cleanups []func() error
+	locks    []*fileLock
+	// ctx holds the span which spans of this client are children of, such as that of the command running it
+	ctx context.Context
+}
+
+// gitCheckout records where a repo was checked out, either into a directory on the host or the volume
+// of a data container
+type gitCheckout struct {
+	cfg         *GitCheckoutConfig
+	info        *GitInfo
+	dir, volume string
 }
 
 // Init initialises the client
@@ -53,7 +80,7 @@ func (c *DockerClient) InitDocker() error {
 	var cli *client.Client
 
 	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
-	cli, err := client.NewClient(dockerHost, "v1.22", nil, defaultHeaders)
+	cli, err := client.NewClient(dockerHost, "v"+dockerAPIVersion, nil, defaultHeaders)
 
 	if err != nil {
 		return fmt.Errorf("Could not connect to Docker daemon on %s: %s", dockerHost, err)
@@ -62,6 +89,14 @@ func (c *DockerClient) InitDocker() error {
 	return nil
 }
 
+// traceContext returns the context spans of this client are started in
+func (c *DockerClient) traceContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // NewDockerClient returns a new DockerClient initialised with the API object
 func NewDockerClient() *DockerClient {
 	c := new(DockerClient)
@@ -150,9 +185,12 @@ func (c *DockerClient) SetWorkDir(wd string) {
 }
 
 // BindFromGit creates a data container with a git clone inside and mounts its volumes inside your app container
-// If there is no valid Git repo set in config, the noGit callback function will be executed instead
+// If there is no valid Git repo set in config, the noGit callback function will be executed instead and the $PWD
+// is assumed to be the code being worked on. Either way, metadata about the commit is added to the container as
+// CALI_GIT_* environment variables when available
 func (c *DockerClient) BindFromGit(cfg *GitCheckoutConfig, noGit func() error) error {
 	cli := NewDockerClient()
+	cli.ctx = c.ctx
 
 	if err := cli.InitDocker(); err != nil {
 		return err
@@ -160,58 +198,325 @@ func (c *DockerClient) BindFromGit(cfg *GitCheckoutConfig, noGit func() error) e
 
 	if cfg.Repo != "" {
 		// Build code from data volume
-		git := cli.Git()
-
-		if cfg.Image != "" {
-			git.Image = cfg.Image
-		}
-		id, err := git.Checkout(cfg)
+		co, err := c.checkoutFromGit(cli, cfg)
 
 		if err != nil {
 			return err
 		}
-		c.HostConf.VolumesFrom = []string{id}
+		c.GitInfo = co.info
+		c.checkout = co
 
 		if cfg.RelPath != "" {
 			c.SetWorkDir(path.Join(workdir, cfg.RelPath))
 		}
 	} else {
 		// Execute callback
-		noGit()
+		if err := noGit(); err != nil {
+			return err
+		}
+
+		if c.GitInfo == nil {
+			info, err := LocalGitInfo(".")
+
+			if err != nil {
+				log.Debugf("No git metadata for working directory: %s", err)
+				return nil
+			}
+			c.GitInfo = info
+		}
+	}
+	c.AddEnvs(c.GitInfo.Envs())
+	return nil
+}
+
+// BindReposFromGit checks out additional repos into data containers of their own and mounts them
+// alongside any volumes already mounted. Repos which have been left empty are skipped
+func (c *DockerClient) BindReposFromGit(cfgs []*GitCheckoutConfig) error {
+	cli := NewDockerClient()
+	cli.ctx = c.ctx
+
+	if err := cli.InitDocker(); err != nil {
+		return err
+	}
+
+	for _, cfg := range cfgs {
+		if cfg.Repo == "" {
+			continue
+		}
+
+		if _, err := c.checkoutFromGit(cli, cfg); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// checkoutFromGit checks out a repo and mounts it. NativeGit is tried first if enabled, falling back to a data
+// container created using cli. Checkouts are locked so that concurrent invocations using the same checkout
+// cannot refresh it while it is in use. The lock is held until Cleanup, unless the task has its own snapshot
+func (c *DockerClient) checkoutFromGit(cli *DockerClient, cfg *GitCheckoutConfig) (co *gitCheckout, err error) {
+	sp := startSpan(c.traceContext(), "git checkout",
+		attribute.String("git.repo", cfg.Repo), attribute.String("git.ref", cfg.ref()))
+	defer func() { sp.end(err) }()
+	cli.ctx = sp.ctx
+	lock, err := acquireLock(cfg.containerName())
+
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil || cfg.Snapshot {
+			lock.Release()
+			return
+		}
+		c.locks = append(c.locks, lock)
+	}()
+
+	if cfg.Native && localDocker() {
+		if co, err = c.checkoutNative(cfg); err != nil {
+			log.Warnf("Native git checkout failed, falling back to git container: %s", err)
+		}
+	}
+
+	if co == nil {
+		if co, err = c.checkoutContainer(cli, cfg); err != nil {
+			return nil, err
+		}
+	}
+	info := co.info
+	info.Ref = cfg.ref()
+	info.Remote = cfg.Repo
+
+	if cfg.Ref == "" {
+		info.Branch = cfg.Branch
+	}
+	log.WithFields(log.Fields{
+		"git_url": cfg.Repo,
+		"ref":     info.Ref,
+		"commit":  info.SHA,
+		"path":    cfg.mountPath(),
+	}).Info("Checked out git repo")
+	return co, nil
+}
+
+// checkoutNative checks out a repo on the host and bind mounts it
+func (c *DockerClient) checkoutNative(cfg *GitCheckoutConfig) (*gitCheckout, error) {
+	git, err := NewNativeGit()
+
+	if err != nil {
+		return nil, err
+	}
+	dir, err := git.Checkout(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+	info, err := git.Info(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Snapshot {
+		if dir, err = git.Snapshot(dir); err != nil {
+			return nil, err
+		}
+		snapshot := dir
+		c.cleanups = append(c.cleanups, func() error {
+			return os.RemoveAll(snapshot)
+		})
+	}
+	c.AddBind(fmt.Sprintf("%s:%s", dir, cfg.mountPath()))
+	return &gitCheckout{cfg: cfg, info: info, dir: dir}, nil
+}
+
+// checkoutContainer uses cli to checkout a repo into a data container and mounts its volumes
+func (c *DockerClient) checkoutContainer(cli *DockerClient, cfg *GitCheckoutConfig) (*gitCheckout, error) {
+	git := cli.Git()
+
+	if cfg.Image != "" {
+		git.Image = cfg.Image
+	}
+	id, err := git.Checkout(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+	info, err := git.Info(id, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Snapshot {
+		if id, err = git.Snapshot(id, cfg); err != nil {
+			return nil, err
+		}
+		snapshot := id
+		c.cleanups = append(c.cleanups, func() error {
+			opts := types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}
+
+			if err := cli.Cli.ContainerRemove(context.Background(), snapshot, opts); err != nil {
+				return fmt.Errorf("Failed to remove snapshot container: %s", err)
+			}
+			return nil
+		})
+	}
+	c.HostConf.VolumesFrom = append(c.HostConf.VolumesFrom, id)
+	return &gitCheckout{cfg: cfg, info: info, volume: id}, nil
+}
+
+// PushToGit commits any changes made by the task to the repo checked out by BindFromGit and pushes them to
+// a branch on its remote. Nothing is done if no branch is configured or the task did not use a git repo
+func (c *DockerClient) PushToGit(cfg *GitPushConfig) error {
+	if cfg.Branch == "" || c.checkout == nil {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"git_url": c.checkout.cfg.Repo,
+		"branch":  cfg.Branch,
+		"dry_run": cfg.DryRun,
+	}).Info("Pushing changes to git repo")
+
+	if c.checkout.dir != "" {
+		git, err := NewNativeGit()
+
+		if err != nil {
+			return err
+		}
+		return git.Push(c.checkout.dir, cfg)
+	}
+	cli := NewDockerClient()
+	cli.ctx = c.ctx
+
+	if err := cli.InitDocker(); err != nil {
+		return err
+	}
+	git := cli.Git()
+
+	if c.checkout.cfg.Image != "" {
+		git.Image = c.checkout.cfg.Image
+	}
+	return git.Push(c.checkout.volume, c.checkout.cfg, cfg)
+}
+
+// Cleanup removes anything temporary created for the container, such as git snapshots, and releases the locks
+// on its git checkouts. It should be called once the container has finished running and any changes are pushed
+func (c *DockerClient) Cleanup() {
+	for _, f := range c.cleanups {
+		if err := f(); err != nil {
+			log.Warn(err)
+		}
+	}
+	c.cleanups = nil
+
+	for _, l := range c.locks {
+		l.Release()
+	}
+	c.locks = nil
+}
+
+// localDocker determines if the Docker daemon runs on this host and so can bind mount its directories
+func localDocker() bool {
+	return strings.HasPrefix(dockerHost, "unix://") || strings.HasPrefix(dockerHost, "npipe://")
+}
+
+// Result describes a container which has run to completion
+type Result struct {
+	ContainerID string
+	Image       string
+	// ImageDigest is the repo digest of the image if it has one, otherwise its ID
+	ImageDigest string
+	ExitCode    int
+	Started     time.Time
+	Finished    time.Time
+	Duration    time.Duration
+}
+
+// ExitError is returned when a container exits with a non-zero status
+type ExitError struct {
+	Code int
+}
+
+// Error implements error
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Non-zero exit status %d from Docker container", e.Code)
+}
+
 // StartContainer will create and start a container with logs and optional cleanup
 func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
+	res, err := c.RunContainer(rm, name)
+
+	if res == nil {
+		return "", err
+	}
+	return res.ContainerID, err
+}
+
+// RunContainer will create and start a container with logs and optional cleanup, returning a Result
+// once it has finished. If the container exits with a non-zero status, the error is an ExitError
+func (c *DockerClient) RunContainer(rm bool, name string) (res *Result, err error) {
+	sp := startSpan(c.traceContext(), "container", attribute.String("image", c.Conf.Image))
+	defer func() { sp.end(err) }()
+	var runSpan *span
+	defer func() {
+		if runSpan != nil {
+			runSpan.end(err)
+		}
+	}()
 	log.WithFields(log.Fields{
 		"image": c.Conf.Image,
 		"envs":  fmt.Sprintf("%v", c.Conf.Env),
 		"cmd":   fmt.Sprintf("%v", c.Conf.Cmd),
 	}).Debug("Creating new container")
 
-	if err := c.PullImage(c.Conf.Image); err != nil {
-		return "", fmt.Errorf("Failed to fetch image: %s", err)
+	if err := c.pullImage(sp.ctx, c.Conf.Image); err != nil {
+		return nil, fmt.Errorf("Failed to fetch image: %s", err)
 	}
+	createSpan := startSpan(sp.ctx, "create")
 	resp, err := c.Cli.ContainerCreate(context.Background(), c.Conf, c.HostConf, c.NetConf, name)
+	createSpan.end(err)
 
 	if err != nil {
-		return "", fmt.Errorf("Failed to create container: %s", err)
+		return nil, fmt.Errorf("Failed to create container: %s", err)
+	}
+	res = &Result{
+		ContainerID: resp.ID,
+		Image:       c.Conf.Image,
+		ImageDigest: c.imageDigest(c.Conf.Image),
 	}
 
-	// Clean up on ctrl+c
+	// Clean up on ctrl+c, returning ErrInterrupted once the container has gone
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, os.Kill)
+	defer signal.Stop(ch)
+	atomic.AddInt32(&containersRunning, 1)
+	defer atomic.AddInt32(&containersRunning, -1)
+	done := make(chan struct{})
+	defer close(done)
+	interrupted := make(chan struct{})
+	wasInterrupted := func() bool {
+		select {
+		case <-interrupted:
+			return true
+		default:
+			return false
+		}
+	}
 
 	go func() {
-		<-ch
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
 		log.Debug("Trapped ctrl+c")
+		close(interrupted)
 
-		if err = c.DeleteContainer(resp.ID); err != nil {
+		if err := c.DeleteContainer(resp.ID); err != nil {
 			log.Errorf("Failed to remove container: %s", err)
 		}
-		os.Exit(1)
 	}()
 	log.WithFields(log.Fields{
 		"image": c.Conf.Image,
@@ -237,11 +542,13 @@ func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
 			Stdout: true,
 			Stderr: true,
 		}
+		attachSpan := startSpan(sp.ctx, "attach")
 		hijack, err := c.Cli.ContainerAttach(context.Background(), resp.ID, ca)
+		attachSpan.end(err)
 		defer hijack.Conn.Close()
 
 		if err != nil {
-			return resp.ID, fmt.Errorf("Failed to start container: %s", err)
+			return res, fmt.Errorf("Failed to start container: %s", err)
 		}
 		oldState, err := terminal.MakeRaw(fd)
 		defer terminal.Restore(fd, oldState)
@@ -250,9 +557,12 @@ func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
 			panic(err)
 		}
 
+		runSpan = startSpan(sp.ctx, "run")
+
 		if err := c.Cli.ContainerStart(context.Background(), resp.ID, types.ContainerStartOptions{}); err != nil {
-			return resp.ID, fmt.Errorf("Failed to start container: %s", err)
+			return res, fmt.Errorf("Failed to start container: %s", err)
 		}
+		res.Started = time.Now()
 
 		// Start stdin reader
 		go func() {
@@ -267,7 +577,7 @@ func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
 		tw, th, _ := terminal.GetSize(fd)
 
 		if err := c.Cli.ContainerResize(context.Background(), resp.ID, types.ResizeOptions{Height: uint(th), Width: uint(tw)}); err != nil {
-			return resp.ID, fmt.Errorf("Failed to start container: %s", err)
+			return res, fmt.Errorf("Failed to start container: %s", err)
 		}
 
 		// Start stdout writer
@@ -276,9 +586,12 @@ func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
 		}
 	} else {
 		// No terminal, then just pump out the log output
+		runSpan = startSpan(sp.ctx, "run")
+
 		if err := c.Cli.ContainerStart(context.Background(), resp.ID, types.ContainerStartOptions{}); err != nil {
-			return resp.ID, fmt.Errorf("Failed to start container: %s", err)
+			return res, fmt.Errorf("Failed to start container: %s", err)
 		}
+		res.Started = time.Now()
 		log.WithFields(log.Fields{
 			"image": c.Conf.Image,
 			"id":    resp.ID[0:12],
@@ -287,31 +600,107 @@ func (c *DockerClient) StartContainer(rm bool, name string) (string, error) {
 		ls, err := c.Cli.ContainerLogs(context.Background(), resp.ID, logOptions)
 
 		if err != nil {
-			return resp.ID, fmt.Errorf("Failed to get container logs: %s", err)
+			return res, fmt.Errorf("Failed to get container logs: %s", err)
 		}
 
 		_, err = io.Copy(os.Stdout, ls)
-		if err != nil {
-			return resp.ID, fmt.Errorf("Failed to get container logs: %s", err)
+		if err != nil && !wasInterrupted() {
+			return res, fmt.Errorf("Failed to get container logs: %s", err)
 		}
 	}
 	// Container has finished running. Get its exit code
+	res.Finished = time.Now()
+	res.Duration = res.Finished.Sub(res.Started)
+
+	if wasInterrupted() {
+		return res, ErrInterrupted
+	}
 	inspect, err := c.Cli.ContainerInspect(context.Background(), resp.ID)
 	if err != nil {
-		return resp.ID, fmt.Errorf("Failed to inspect Docker container: %s", err)
+		return res, fmt.Errorf("Failed to inspect Docker container: %s", err)
+	}
+
+	res.ExitCode = inspect.State.ExitCode
+	var exitErr error
+
+	if res.ExitCode != 0 {
+		exitErr = &ExitError{Code: res.ExitCode}
 	}
+	runSpan.SetAttributes(attribute.Int("exit_code", res.ExitCode))
+	runSpan.end(exitErr)
 
 	if rm {
 
 		if err = c.DeleteContainer(resp.ID); err != nil {
-			return resp.ID, fmt.Errorf("Failed to remove container: %s", err)
+			return res, fmt.Errorf("Failed to remove container: %s", err)
+		}
+	}
+	return res, exitErr
+}
+
+// CaptureContainer will create and run a container to completion without a TTY, returning its stdout. The
+// container is always removed once it has finished
+func (c *DockerClient) CaptureContainer() (string, error) {
+	return c.captureContainer(context.Background())
+}
+
+// captureContainer runs a container as CaptureContainer does, giving up once ctx is done
+func (c *DockerClient) captureContainer(ctx context.Context) (string, error) {
+	c.Conf.Tty = false
+
+	if err := c.PullImage(c.Conf.Image); err != nil {
+		return "", fmt.Errorf("Failed to fetch image: %s", err)
+	}
+	resp, err := c.Cli.ContainerCreate(ctx, c.Conf, c.HostConf, c.NetConf, "")
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create container: %s", err)
+	}
+	defer func() {
+		if err := c.DeleteContainer(resp.ID); err != nil {
+			log.Warn(err)
 		}
+	}()
+
+	if err := c.Cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", fmt.Errorf("Failed to start container: %s", err)
+	}
+	logOptions := types.ContainerLogsOptions{Follow: true, ShowStdout: true, ShowStderr: true}
+	ls, err := c.Cli.ContainerLogs(ctx, resp.ID, logOptions)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to get container logs: %s", err)
+	}
+	defer ls.Close()
+	var stdout, stderr bytes.Buffer
+
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, ls); err != nil {
+		return "", fmt.Errorf("Failed to get container logs: %s", err)
+	}
+	inspect, err := c.Cli.ContainerInspect(ctx, resp.ID)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to inspect Docker container: %s", err)
 	}
 
 	if inspect.State.ExitCode != 0 {
-		return resp.ID, fmt.Errorf("Non-zero exit status from Docker container")
+		return "", fmt.Errorf("Non-zero exit status from Docker container: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// imageDigest returns the repo digest of image if it has one, otherwise its ID
+func (c *DockerClient) imageDigest(image string) string {
+	inspect, _, err := c.Cli.ImageInspectWithRaw(context.Background(), image)
+
+	if err != nil {
+		return ""
+	}
+
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0]
 	}
-	return resp.ID, nil
+	return inspect.ID
 }
 
 // ContainerExists determines if the container with this name exist
@@ -357,6 +746,13 @@ func (c *DockerClient) ImageExists(image string) bool {
 
 // PullImage - Pull an image locally
 func (c *DockerClient) PullImage(image string) error {
+	return c.pullImage(c.traceContext(), image)
+}
+
+// pullImage pulls an image in a span which is a child of the span in ctx
+func (c *DockerClient) pullImage(ctx context.Context, image string) (err error) {
+	sp := startSpan(ctx, "pull", attribute.String("image", image))
+	defer func() { sp.end(err) }()
 
 	if !c.ImageExists(image) {
 		log.WithFields(log.Fields{
@@ -0,0 +1,347 @@
+package cali
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+)
+
+const (
+	// CheckPass means nothing is wrong
+	CheckPass CheckStatus = "pass"
+	// CheckWarn means something may stop some commands working
+	CheckWarn CheckStatus = "warn"
+	// CheckFail means something will stop commands working
+	CheckFail CheckStatus = "fail"
+
+	// Free disk space below which the disk check warns or fails
+	diskWarnBytes = 5 << 30
+	diskFailBytes = 1 << 30
+
+	// annotationIgnoreConfigErrs marks a command which runs even if config cannot be read or used
+	annotationIgnoreConfigErrs = "cali.ignore-config-errors"
+)
+
+// CheckStatus is the outcome of a doctor check
+type CheckStatus string
+
+// CheckResult is the outcome of a doctor check, with a hint on how to fix it if it did not pass
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Hint    string      `json:"hint,omitempty"`
+}
+
+// CheckFunc checks something about the environment for the doctor command
+type CheckFunc func() CheckResult
+
+// check is a named CheckFunc
+type check struct {
+	name string
+	f    CheckFunc
+}
+
+// AddCheck adds a check to those run by the doctor command, after the built in checks
+func (c *cli) AddCheck(name string, f CheckFunc) {
+	c.checks = append(c.checks, check{name: name, f: f})
+}
+
+// addDoctor adds the doctor command, which checks the environment commands run in
+func (c *cli) addDoctor() {
+	if c.hasCommand("doctor") {
+		return
+	}
+	var output string
+	cmd := newCommand("doctor")
+	cmd.SetShort("Check for problems with the environment commands run in")
+	cmd.cobra.Annotations = map[string]string{annotationIgnoreConfigErrs: "true"}
+	cmd.cobra.Flags().StringVarP(&output, "output", "o", "text", "Output format, text or json")
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		if output != "text" && output != "json" {
+			return fmt.Errorf("Unknown output format %s, must be text or json", output)
+		}
+		cc.SilenceUsage = true
+		results := c.doctor()
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err := enc.Encode(results); err != nil {
+				return err
+			}
+		} else {
+			printResults(results)
+		}
+		var failed int
+
+		for _, r := range results {
+			if r.Status == CheckFail {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	}
+	c.cmds["doctor"] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
+
+// doctor runs the built in checks followed by any added with AddCheck
+func (c *cli) doctor() []CheckResult {
+	checks := []check{
+		{"Docker daemon", checkDocker},
+		{"Disk space", checkDisk},
+		{"AWS config", checkAWS},
+		{"Working directory", checkWorkdir},
+		{"Git", checkGit},
+		{"Git credentials", checkGitCredentials},
+		{"Config files", c.checkConfig},
+	}
+	var results []CheckResult
+
+	for _, ch := range append(checks, c.checks...) {
+		r := ch.f()
+
+		if r.Name == "" {
+			r.Name = ch.name
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// printResults prints a report of the results for people
+func printResults(results []CheckResult) {
+	for _, r := range results {
+		fmt.Printf("[%s] %s: %s\n", r.Status, r.Name, r.Message)
+
+		if r.Hint != "" && r.Status != CheckPass {
+			fmt.Printf("       %s\n", r.Hint)
+		}
+	}
+}
+
+// checkDocker checks the Docker daemon can be reached and speaks a compatible API version
+func checkDocker() CheckResult {
+	cli := NewDockerClient()
+
+	if err := cli.InitDocker(); err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error(), Hint: "Check the value of --docker-host"}
+	}
+	v, err := cli.Cli.ServerVersion(context.Background())
+
+	if err != nil {
+		r := CheckResult{Status: CheckFail, Message: fmt.Sprintf("Cannot reach %s: %s", dockerHost, err)}
+
+		if strings.Contains(err.Error(), "permission denied") {
+			r.Hint = "Add your user to the docker group, then log out and back in"
+		} else {
+			r.Hint = "Start the Docker daemon, or check the value of --docker-host"
+		}
+		return r
+	}
+	msg := fmt.Sprintf("Docker %s at %s, API version %s", v.Version, dockerHost, v.APIVersion)
+
+	if compareVersions(v.APIVersion, dockerAPIVersion) < 0 {
+		return CheckResult{
+			Status:  CheckFail,
+			Message: msg,
+			Hint:    fmt.Sprintf("Upgrade Docker to one supporting API version %s or later", dockerAPIVersion),
+		}
+	}
+
+	if v.MinAPIVersion != "" && compareVersions(v.MinAPIVersion, dockerAPIVersion) > 0 {
+		return CheckResult{
+			Status:  CheckFail,
+			Message: fmt.Sprintf("%s, which no longer supports API version %s", msg, dockerAPIVersion),
+			Hint:    fmt.Sprintf("Update %s, or set DOCKER_MIN_API_VERSION=%s for the Docker daemon", cliName, dockerAPIVersion),
+		}
+	}
+	return CheckResult{Status: CheckPass, Message: msg}
+}
+
+// checkDisk checks the Docker daemon has space for images, containers and checkouts. This can only be
+// checked when the daemon keeps them on this host
+func checkDisk() CheckResult {
+	if !localDocker() {
+		return CheckResult{
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("Unable to check free space, as Docker at %s is not local", dockerHost),
+			Hint:    "Check there is space on the Docker host",
+		}
+	}
+	cli := NewDockerClient()
+
+	if err := cli.InitDocker(); err != nil {
+		return CheckResult{Status: CheckWarn, Message: fmt.Sprintf("Unable to check free space: %s", err)}
+	}
+	info, err := cli.Cli.Info(context.Background())
+
+	if err != nil {
+		return CheckResult{Status: CheckWarn, Message: fmt.Sprintf("Unable to check free space: %s", err)}
+	}
+
+	if info.OSType != runtime.GOOS {
+		return CheckResult{
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("Unable to check free space, as Docker runs in a %s VM", info.OSType),
+			Hint:    "Check the disk usage settings of Docker",
+		}
+	}
+	free, err := freeSpace(info.DockerRootDir)
+
+	if err != nil {
+		return CheckResult{Status: CheckWarn, Message: fmt.Sprintf("Unable to find free space in %s: %s", info.DockerRootDir, err)}
+	}
+	msg := fmt.Sprintf("%.1fGB free in %s", float64(free)/(1<<30), info.DockerRootDir)
+	hint := "Free up space, e.g. with docker system prune"
+
+	switch {
+	case free < diskFailBytes:
+		return CheckResult{Status: CheckFail, Message: msg, Hint: hint}
+	case free < diskWarnBytes:
+		return CheckResult{Status: CheckWarn, Message: msg, Hint: hint}
+	}
+	return CheckResult{Status: CheckPass, Message: msg}
+}
+
+// checkAWS checks ~/.aws, which SetDefaults binds into every task container, exists
+func checkAWS() CheckResult {
+	home, err := homeDir()
+
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error()}
+	}
+	dir := filepath.Join(home, ".aws")
+
+	if _, err := os.Stat(dir); err != nil {
+		return CheckResult{
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("%s does not exist", dir),
+			Hint:    "Run aws configure, or create it if your tools do not need AWS credentials",
+		}
+	}
+	return CheckResult{Status: CheckPass, Message: fmt.Sprintf("%s exists", dir)}
+}
+
+// checkWorkdir checks the working directory, which SetDefaults binds into task containers, can be bound
+func checkWorkdir() CheckResult {
+	pwd, err := os.Getwd()
+
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error()}
+	}
+
+	if !localDocker() {
+		return CheckResult{
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("%s cannot be bound as Docker is not local", pwd),
+			Hint:    "Use --git or --clean-workspace to run against code on a remote Docker host",
+		}
+	}
+	return CheckResult{Status: CheckPass, Message: fmt.Sprintf("%s can be bound", pwd)}
+}
+
+// checkGit checks git is installed on the host, which is needed to describe and copy local repos
+func checkGit() CheckResult {
+	out, err := exec.Command("git", "--version").Output()
+
+	if err != nil {
+		return CheckResult{
+			Status:  CheckWarn,
+			Message: "git is not installed",
+			Hint:    "Install git to use --clean-workspace and to pass CALI_GIT_* variables for local repos",
+		}
+	}
+	return CheckResult{Status: CheckPass, Message: strings.TrimSpace(string(out))}
+}
+
+// checkGitCredentials checks there are credentials to check out private repos with --git
+func checkGitCredentials() CheckResult {
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		return CheckResult{Status: CheckPass, Message: "SSH agent is running"}
+	}
+	home, err := homeDir()
+
+	if err != nil {
+		return CheckResult{Status: CheckWarn, Message: err.Error()}
+	}
+
+	for _, key := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		path := filepath.Join(home, ".ssh", key)
+
+		if _, err := os.Stat(path); err == nil {
+			return CheckResult{Status: CheckPass, Message: fmt.Sprintf("Found SSH key %s", path)}
+		}
+	}
+
+	if os.Getenv("GIT_TOKEN") != "" {
+		return CheckResult{Status: CheckPass, Message: "GIT_TOKEN is set for HTTPS repos"}
+	}
+	return CheckResult{
+		Status:  CheckWarn,
+		Message: "No SSH agent, SSH key or GIT_TOKEN found",
+		Hint:    "Start an SSH agent and ssh-add your key, or set GIT_TOKEN, to use --git with private repos",
+	}
+}
+
+// checkConfig checks the config and command definition files could be read and used
+func (c *cli) checkConfig() CheckResult {
+	var used, problems []string
+
+	for _, err := range c.configErrs {
+		problems = append(problems, err.Error())
+	}
+	v := viper.New()
+
+	if c.cfgFile != nil && *c.cfgFile != "" {
+		v.SetConfigFile(*c.cfgFile)
+	} else {
+		v.SetConfigName("." + c.name)
+		v.AddConfigPath("$HOME")
+	}
+	files := []*viper.Viper{v}
+	cmds := viper.New()
+	cmds.SetConfigName(fmt.Sprintf(".%s-commands", c.name))
+	cmds.AddConfigPath("$HOME")
+	files = append(files, cmds)
+
+	if path, err := findProjectConfig(c.name); err == nil && path != "" {
+		p := viper.New()
+		p.SetConfigFile(path)
+		files = append(files, p)
+	}
+
+	for _, f := range files {
+		// Files which cannot be read are already in configErrs
+		if err := f.ReadInConfig(); err == nil {
+			used = append(used, f.ConfigFileUsed())
+		}
+	}
+
+	if len(problems) > 0 {
+		return CheckResult{
+			Status:  CheckFail,
+			Message: strings.Join(problems, "; "),
+			Hint:    "Fix or remove the config files or values which cannot be used",
+		}
+	}
+
+	if len(used) == 0 {
+		return CheckResult{Status: CheckPass, Message: "No config files"}
+	}
+	return CheckResult{Status: CheckPass, Message: fmt.Sprintf("Read %s", strings.Join(used, ", "))}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package cali
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem containing dir
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package cali
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// freeSpace returns the bytes available to the user on the volume containing dir
+func freeSpace(dir string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+
+	if err != nil {
+		return 0, err
+	}
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	var free uint64
+
+	if r, _, err := proc.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return free, nil
+}
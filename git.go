@@ -4,19 +4,319 @@ import (
 	"crypto/md5"
 	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
+	"golang.org/x/net/context"
 )
 
-// GitCheckoutConfig is input for Git.Checkout
+// GitCheckoutConfig is input for Git.Checkout. Ref may be a tag, a full or abbreviated commit SHA or any
+// other ref such as refs/pull/123/head and takes precedence over Branch when set
 type GitCheckoutConfig struct {
-	Repo, Branch, RelPath, Image string
+	Repo, Branch, Ref, RelPath, Image string
+	// Fresh removes any existing data container and clones from scratch
+	Fresh bool
+	// Submodules recursively checks out submodules
+	Submodules bool
+	// LFS fetches Git LFS objects, which requires git-lfs to be installed in the git image
+	LFS bool
+	// Sparse limits the worktree to RelPath
+	Sparse bool
+	// Depth limits the history fetched to this many commits, defaulting to 1. A negative depth fetches the
+	// full history
+	Depth int
+	// MountPath is where the checkout is mounted in the task container, defaulting to /tmp/workspace
+	MountPath string
+	// Native checks out using NativeGit rather than a git container when the Docker daemon is local
+	Native bool
+	// Snapshot gives the task its own copy of the checkout, so concurrent invocations never see each
+	// other's changes
+	Snapshot bool
+}
+
+// ref returns the ref which should be checked out
+func (cfg *GitCheckoutConfig) ref() string {
+	if cfg.Ref != "" {
+		return cfg.Ref
+	}
+	return cfg.Branch
+}
+
+// depth returns the number of commits of history to fetch, or zero for the full history
+func (cfg *GitCheckoutConfig) depth() int {
+	switch {
+	case cfg.Depth == 0:
+		return 1
+	case cfg.Depth < 0:
+		return 0
+	}
+	return cfg.Depth
+}
+
+// sparse returns true if the worktree should be limited to RelPath
+func (cfg *GitCheckoutConfig) sparse() bool {
+	return cfg.Sparse && cfg.RelPath != ""
+}
+
+// mountPath returns where the checkout is mounted in the task container
+func (cfg *GitCheckoutConfig) mountPath() string {
+	if cfg.MountPath != "" {
+		return cfg.MountPath
+	}
+	return workdir
+}
+
+// containerName returns the name of the data container holding the checkout. Sparse checkouts are kept
+// apart from full ones as the sparse config lives inside the container, and checkouts mounted elsewhere
+// need their own volume
+func (cfg *GitCheckoutConfig) containerName() string {
+	key := cfg.Repo + cfg.ref()
+
+	if cfg.sparse() {
+		key += ":" + cfg.RelPath
+	}
+
+	if cfg.mountPath() != workdir {
+		key += "@" + cfg.mountPath()
+	}
+	return fmt.Sprintf("data_%x", md5.Sum([]byte(key)))
+}
+
+// envs returns the environment used by checkoutScript
+func (cfg *GitCheckoutConfig) envs() []string {
+	envs := []string{
+		"GIT_REPO=" + cfg.Repo,
+		"GIT_REF=" + cfg.ref(),
+		"GIT_SPARSE_PATH=" + cfg.RelPath,
+	}
+
+	if !cfg.LFS {
+		// Don't fail checking out LFS pointers when git-lfs is installed in the image
+		envs = append(envs, "GIT_LFS_SKIP_SMUDGE=1")
+	}
+	return envs
 }
 
 const gitImage = "indiehosters/git:latest"
 
+// checkoutScript builds a script which checks out a single ref, shallowly unless Depth is negative. Refs which
+// cannot be fetched directly, such as abbreviated commit SHAs, fall back to fetching all branches and tags
+// and then checking out the ref. The worktree is always reset and cleaned so it exactly matches the ref.
+// User supplied values are passed in via the environment set by cfg.envs()
+func checkoutScript(cfg *GitCheckoutConfig) string {
+	depth := ""
+
+	if d := cfg.depth(); d > 0 {
+		depth = fmt.Sprintf("--depth %d", d)
+	}
+	lines := []string{
+		"set -e",
+		"[ -d .git ] || git init -q .",
+		"git remote remove origin 2>/dev/null || true",
+		`git remote add origin "$GIT_REPO"`,
+	}
+
+	if cfg.sparse() {
+		lines = append(lines,
+			"git config core.sparseCheckout true",
+			`printf '%s/\n' "$GIT_SPARSE_PATH" > .git/info/sparse-checkout`,
+		)
+	}
+	lines = append(lines,
+		fmt.Sprintf(`if git fetch -q %s origin "$GIT_REF"; then`, depth),
+		"  git checkout -q --force FETCH_HEAD",
+		"else",
+		`  unshallow=""`,
+		`  [ -f .git/shallow ] && unshallow="--unshallow"`,
+		`  git fetch -q --tags $unshallow origin '+refs/heads/*:refs/remotes/origin/*'`,
+		`  git checkout -q --force "$GIT_REF"`,
+		"fi",
+		"git reset -q --hard HEAD",
+		"git clean -q -ffdx",
+	)
+
+	if cfg.Submodules {
+		lines = append(lines,
+			fmt.Sprintf("git submodule update -q --init --recursive --force %s", depth),
+			"git submodule foreach -q --recursive 'git reset -q --hard HEAD && git clean -q -ffdx'",
+		)
+	}
+
+	if cfg.LFS {
+		lines = append(lines, "git lfs install --local", "git lfs pull")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// infoScript prints the metadata needed to populate GitInfo as key=value pairs
+const infoScript = `printf 'sha=%s\n' "$(git rev-parse HEAD)"
+printf 'branch=%s\n' "$(git rev-parse --abbrev-ref HEAD)"
+printf 'remote=%s\n' "$(git config --get remote.origin.url)"
+printf 'author=%s\n' "$(git log -1 --format='%an <%ae>')"
+printf 'dirty=%s\n' "$(git status --porcelain | head -n 1)"`
+
+// GitInfo describes the commit a task is running against
+type GitInfo struct {
+	SHA, Branch, Ref, Remote, Author string
+	Dirty                            bool
+}
+
+// Envs returns the metadata as environment variables to be injected into a task container
+func (i *GitInfo) Envs() []string {
+	short := i.SHA
+
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	return []string{
+		"CALI_GIT_SHA=" + i.SHA,
+		"CALI_GIT_SHORT_SHA=" + short,
+		"CALI_GIT_BRANCH=" + i.Branch,
+		"CALI_GIT_REF=" + i.Ref,
+		"CALI_GIT_REMOTE=" + i.Remote,
+		"CALI_GIT_AUTHOR=" + i.Author,
+		fmt.Sprintf("CALI_GIT_DIRTY=%t", i.Dirty),
+	}
+}
+
+// parseGitInfo parses the output of infoScript
+func parseGitInfo(out string) *GitInfo {
+	info := new(GitInfo)
+
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "sha":
+			info.SHA = kv[1]
+		case "branch":
+			// A detached HEAD has no branch
+			if kv[1] != "HEAD" {
+				info.Branch = kv[1]
+			}
+		case "remote":
+			info.Remote = kv[1]
+		case "author":
+			info.Author = kv[1]
+		case "dirty":
+			info.Dirty = kv[1] != ""
+		}
+	}
+	info.Ref = info.Branch
+	return info
+}
+
+// LocalGitInfo returns metadata about a git working tree on the host. It requires git to be installed
+// on the host and returns an error if it is not, or if dir is not inside a working tree
+func LocalGitInfo(dir string) (*GitInfo, error) {
+	sha, err := hostGit(dir, "rev-parse", "HEAD")
+
+	if err != nil {
+		return nil, err
+	}
+	info := &GitInfo{SHA: sha}
+
+	if branch, err := hostGit(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		info.Branch = branch
+	}
+	info.Ref = info.Branch
+	info.Remote, _ = hostGit(dir, "config", "--get", "remote.origin.url")
+	info.Author, _ = hostGit(dir, "log", "-1", "--format=%an <%ae>")
+	status, _ := hostGit(dir, "status", "--porcelain")
+	info.Dirty = status != ""
+	return info, nil
+}
+
+// hostGit runs git on the host inside dir and returns its trimmed output
+func hostGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pushScript commits any changes in the worktree and pushes them to a branch, or prints the diff when
+// $GIT_PUSH_DRY_RUN is set. User supplied values are passed in via the environment set by GitPushConfig.envs()
+const pushScript = `set -e
+git add -A
+if git diff --cached --quiet; then
+  echo "No changes to push"
+  exit 0
+fi
+if [ -n "$GIT_PUSH_DRY_RUN" ]; then
+  git --no-pager diff --cached --stat
+  git --no-pager diff --cached
+  git reset -q
+  exit 0
+fi
+git commit -q -m "$GIT_PUSH_MESSAGE"
+git push origin "HEAD:refs/heads/$GIT_PUSH_BRANCH"`
+
+// GitPushConfig is input for pushing changes made by a task to a git checkout back to its remote
+type GitPushConfig struct {
+	// Branch is pushed to, and created if it does not exist. Nothing is pushed if it is empty
+	Branch string
+	// Message of the commit, which has a default if empty
+	Message string
+	// Author of the commit in the form "Name <email>", which has a default if empty
+	Author string
+	// DryRun prints the changes rather than committing and pushing them
+	DryRun bool
+}
+
+// author returns the name and email of the commit author
+func (cfg *GitPushConfig) author() (string, string) {
+	author := cfg.Author
+
+	if author == "" {
+		author = fmt.Sprintf("%s <%s@localhost>", cliName, cliName)
+	}
+	parts := strings.SplitN(author, "<", 2)
+
+	if len(parts) != 2 {
+		return strings.TrimSpace(author), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSuffix(strings.TrimSpace(parts[1]), ">")
+}
+
+// message returns the commit message
+func (cfg *GitPushConfig) message() string {
+	if cfg.Message != "" {
+		return cfg.Message
+	}
+	return fmt.Sprintf("Changes made by %s", cliName)
+}
+
+// envs returns the environment used by pushScript
+func (cfg *GitPushConfig) envs() []string {
+	name, email := cfg.author()
+	envs := []string{
+		"GIT_PUSH_BRANCH=" + cfg.Branch,
+		"GIT_PUSH_MESSAGE=" + cfg.message(),
+		"GIT_AUTHOR_NAME=" + name,
+		"GIT_AUTHOR_EMAIL=" + email,
+		"GIT_COMMITTER_NAME=" + name,
+		"GIT_COMMITTER_EMAIL=" + email,
+	}
+
+	if cfg.DryRun {
+		envs = append(envs, "GIT_PUSH_DRY_RUN=1")
+	}
+	return envs
+}
+
 // Git returns a new instance
 func (c *DockerClient) Git() *Git {
 	return &Git{c: c, Image: gitImage}
@@ -29,54 +329,201 @@ type Git struct {
 }
 
 // GitCheckout will create and start a container, checkout repo and leave container stopped
-// so volume can be imported
+// so volume can be imported. An existing data container is refreshed to the requested ref, discarding
+// any changes left behind by previous tasks, unless Fresh is set in which case it is recreated
 func (g *Git) Checkout(cfg *GitCheckoutConfig) (string, error) {
-	name := fmt.Sprintf("data_%x", md5.Sum([]byte(cfg.Repo+cfg.Branch)))
+	name := cfg.containerName()
 
 	if g.c.ContainerExists(name) {
-		log.Infof("Existing data container found: %s", name)
+		if !cfg.Fresh {
+			log.Infof("Existing data container found: %s", name)
 
-		if _, err := g.Pull(name); err != nil {
-			log.Warnf("Git pull error: %s", err)
-			return name, err
-		}
-		return name, nil
-	} else {
-		log.WithFields(log.Fields{
-			"git_url": cfg.Repo,
-			"image":   g.Image,
-		}).Info("Creating data containers")
-
-		co := container.Config{
-			Cmd:          []string{"clone", cfg.Repo, "-b", cfg.Branch, "--depth", "1", "."},
-			Image:        gitImage,
-			Tty:          true,
-			AttachStdout: true,
-			AttachStderr: true,
-			WorkingDir:   "/tmp/workspace",
-			Entrypoint:   []string{"git"},
+			if _, err := g.Fetch(name, cfg); err != nil {
+				log.Warnf("Git fetch error: %s", err)
+				return name, err
+			}
+			return name, nil
 		}
-		hc := container.HostConfig{
-			Binds: []string{
-				"/tmp/workspace",
-				fmt.Sprintf("%s/.ssh:/root/.ssh", os.Getenv("HOME")),
-			},
+		log.Infof("Removing existing data container: %s", name)
+		// The checkout lives in an anonymous volume, which would otherwise be left behind
+		opts := types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}
+
+		if err := g.c.Cli.ContainerRemove(context.Background(), name, opts); err != nil {
+			return "", fmt.Errorf("Failed to remove data container %s: %s", name, err)
 		}
-		nc := network.NetworkingConfig{}
+	}
+	log.WithFields(log.Fields{
+		"git_url": cfg.Repo,
+		"image":   g.Image,
+	}).Info("Creating data containers")
 
-		g.c.SetConf(&co)
-		g.c.SetHostConf(&hc)
-		g.c.SetNetConf(&nc)
+	co := container.Config{
+		Cmd:          []string{checkoutScript(cfg)},
+		Image:        g.Image,
+		Tty:          true,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   cfg.mountPath(),
+		Entrypoint:   []string{"sh", "-c"},
+		Env:          cfg.envs(),
+	}
+	hc := container.HostConfig{
+		Binds: []string{
+			cfg.mountPath(),
+			fmt.Sprintf("%s/.ssh:/root/.ssh", os.Getenv("HOME")),
+		},
+	}
+	nc := network.NetworkingConfig{}
 
-		id, err := g.c.StartContainer(false, name)
+	g.c.SetConf(&co)
+	g.c.SetHostConf(&hc)
+	g.c.SetNetConf(&nc)
+
+	id, err := g.c.StartContainer(false, name)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create data container for %s: %s", cfg.Repo, err)
+	}
+	return id, nil
+}
+
+// Fetch will fetch and checkout the configured ref inside an existing data container, resetting and
+// cleaning the worktree
+func (g *Git) Fetch(name string, cfg *GitCheckoutConfig) (string, error) {
+	co := container.Config{
+		Cmd:          []string{checkoutScript(cfg)},
+		Image:        g.Image,
+		Tty:          true,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   cfg.mountPath(),
+		Entrypoint:   []string{"sh", "-c"},
+		Env:          cfg.envs(),
+	}
+	hc := container.HostConfig{
+		VolumesFrom: []string{name},
+		Binds: []string{
+			fmt.Sprintf("%s/.ssh:/root/.ssh", os.Getenv("HOME")),
+		},
+	}
+	nc := network.NetworkingConfig{}
+
+	g.c.SetConf(&co)
+	g.c.SetHostConf(&hc)
+	g.c.SetNetConf(&nc)
+
+	return g.c.StartContainer(true, "")
+}
+
+// Info returns metadata about the commit currently checked out in a data container
+func (g *Git) Info(name string, cfg *GitCheckoutConfig) (*GitInfo, error) {
+	co := container.Config{
+		Cmd:          []string{infoScript},
+		Image:        g.Image,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   cfg.mountPath(),
+		Entrypoint:   []string{"sh", "-c"},
+	}
+	hc := container.HostConfig{
+		VolumesFrom: []string{name},
+	}
+	nc := network.NetworkingConfig{}
+
+	g.c.SetConf(&co)
+	g.c.SetHostConf(&hc)
+	g.c.SetNetConf(&nc)
+
+	out, err := g.c.CaptureContainer()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve commit in %s: %s", name, err)
+	}
+	return parseGitInfo(out), nil
+}
+
+// Snapshot copies the checkout in a data container into a new data container, so that a task can modify it
+// without affecting other invocations using the same checkout. The caller is responsible for removing it
+func (g *Git) Snapshot(name string, cfg *GitCheckoutConfig) (string, error) {
+	inspect, err := g.c.Cli.ContainerInspect(context.Background(), name)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to inspect data container %s: %s", name, err)
+	}
+	var volume string
 
-		if err != nil {
-			return "", fmt.Errorf("Failed to create data container for %s: %s", cfg.Repo, err)
+	for _, m := range inspect.Mounts {
+		if m.Destination == cfg.mountPath() {
+			volume = m.Name
 		}
-		return id, nil
 	}
+
+	if volume == "" {
+		return "", fmt.Errorf("Data container %s has no volume at %s", name, cfg.mountPath())
+	}
+	co := container.Config{
+		Cmd:          []string{`cp -a /tmp/source/. "$GIT_MOUNT_PATH"`},
+		Image:        g.Image,
+		Tty:          true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Entrypoint:   []string{"sh", "-c"},
+		Env:          []string{"GIT_MOUNT_PATH=" + cfg.mountPath()},
+		Labels:       map[string]string{labelCli: cliName, labelTemporary: "true"},
+	}
+	hc := container.HostConfig{
+		Binds: []string{
+			cfg.mountPath(),
+			volume + ":/tmp/source:ro",
+		},
+	}
+	nc := network.NetworkingConfig{}
+
+	g.c.SetConf(&co)
+	g.c.SetHostConf(&hc)
+	g.c.SetNetConf(&nc)
+
+	id, err := g.c.StartContainer(false, "")
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to snapshot data container %s: %s", name, err)
+	}
+	return id, nil
+}
+
+// Push commits any changes in a data container and pushes them to a branch on the remote, or prints the
+// diff if DryRun is set
+func (g *Git) Push(name string, checkout *GitCheckoutConfig, cfg *GitPushConfig) error {
+	co := container.Config{
+		Cmd:          []string{pushScript},
+		Image:        g.Image,
+		Tty:          true,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   checkout.mountPath(),
+		Entrypoint:   []string{"sh", "-c"},
+		Env:          cfg.envs(),
+	}
+	hc := container.HostConfig{
+		VolumesFrom: []string{name},
+		Binds: []string{
+			fmt.Sprintf("%s/.ssh:/root/.ssh", os.Getenv("HOME")),
+		},
+	}
+	nc := network.NetworkingConfig{}
+
+	g.c.SetConf(&co)
+	g.c.SetHostConf(&hc)
+	g.c.SetNetConf(&nc)
+
+	if _, err := g.c.StartContainer(true, ""); err != nil {
+		return fmt.Errorf("Failed to push to %s: %s", cfg.Branch, err)
+	}
+	return nil
 }
 
+// Pull will run git pull inside an existing data container. Checkout uses Fetch instead, which copes
+// with force pushed branches and changes made to the worktree by previous tasks
 func (g *Git) Pull(name string) (string, error) {
 	co := container.Config{
 		Cmd:          []string{"pull"},
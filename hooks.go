@@ -0,0 +1,133 @@
+package cali
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+)
+
+// ErrInterrupted is returned when a Task is stopped by ctrl+c
+var ErrInterrupted = errors.New("Interrupted")
+
+// errFatal is passed to post run and failure hooks when a Task exits with log.Fatal
+var errFatal = errors.New("Exited with a fatal error")
+
+// PreRunHook is run before a command's Task, after its init funcs. Returning an error stops the Task
+// from running, although post run and failure hooks are still run
+type PreRunHook func(t *Task, args []string) error
+
+// PostRunHook is run after a command's Task with its Result and error, either of which may be nil
+type PostRunHook func(t *Task, res *Result, err error)
+
+// AddPreRunHook adds a hook which is run before the Task of this command and any nested under it.
+// Hooks added to the cli are run for every command
+func (c *command) AddPreRunHook(f PreRunHook) {
+	c.preHooks = append(c.preHooks, f)
+}
+
+// AddPostRunHook adds a hook which is run after the Task of this command and any nested under it, whether
+// or not it succeeded, e.g. to send notifications or upload reports. Hooks added to the cli are run for
+// every command
+func (c *command) AddPostRunHook(f PostRunHook) {
+	c.postHooks = append(c.postHooks, f)
+}
+
+// AddFailureHook adds a hook which is run only if the Task of this command or any nested under it fails
+// or is interrupted. Hooks added to the cli are run for every command
+func (c *command) AddFailureHook(f PostRunHook) {
+	c.failureHooks = append(c.failureHooks, f)
+}
+
+// runTask prepares and runs t with the hooks of the command and its parents. Pre run hooks are run outermost
+// first, and post run and failure hooks innermost first. The post run and failure hooks are also run if t
+// cannot be prepared, the process is interrupted outside RunContainer, or the Task exits with log.Fatal
+func (c *command) runTask(t *Task, args []string) (err error) {
+	sp := startSpan(context.Background(), c.path(), attribute.StringSlice("args", redactArgs(args, c.cobra.Flags())))
+	var res *Result
+	defer func() {
+		if res != nil {
+			sp.SetAttributes(attribute.Int("exit_code", res.ExitCode))
+		}
+		sp.end(err)
+	}()
+	t.ctx = sp.ctx
+	lineage := c.lineage()
+	var once sync.Once
+	after := func(res *Result, err error) {
+		once.Do(func() { runPostHooks(lineage, t, res, err) })
+	}
+	log.RegisterExitHandler(func() {
+		after(nil, errFatal)
+		sp.end(errFatal)
+		shutdownTracing()
+	})
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	defer signal.Stop(ch)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+
+			// A running container is removed by RunContainer, which then returns ErrInterrupted
+			if atomic.LoadInt32(&containersRunning) > 0 {
+				continue
+			}
+			after(nil, ErrInterrupted)
+			sp.end(ErrInterrupted)
+			shutdownTracing()
+			os.Exit(exitCode(ErrInterrupted))
+		}
+	}()
+
+	if err = c.initTask(args); err == nil {
+		err = runPreHooks(lineage, t, args)
+	}
+
+	if err == nil {
+		res, err = t.f(t, args)
+	}
+	after(res, err)
+	return err
+}
+
+// runPreHooks runs the pre run hooks of lineage outermost first, stopping at the first to return an error
+func runPreHooks(lineage []*command, t *Task, args []string) error {
+	for _, cmd := range lineage {
+		for _, f := range cmd.preHooks {
+			if err := f(t, args); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runPostHooks runs the post run hooks of lineage, and its failure hooks if err is not nil, innermost first
+func runPostHooks(lineage []*command, t *Task, res *Result, err error) {
+	for i := len(lineage) - 1; i >= 0; i-- {
+		for _, f := range lineage[i].postHooks {
+			f(t, res, err)
+		}
+	}
+
+	if err != nil {
+		for i := len(lineage) - 1; i >= 0; i-- {
+			for _, f := range lineage[i].failureHooks {
+				f(t, res, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package cali
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunTaskHooksWhenPrepareFails(t *testing.T) {
+	c := Cli("test")
+	cmd := c.Command("terraform")
+	ran := false
+	task := cmd.Task(RunFunc(func(t *Task, args []string) (*Result, error) {
+		ran = true
+		return nil, nil
+	}))
+	myFlags.Set("terraform.mounts", []string{"no-destination"})
+	var post, failure error
+	c.AddPostRunHook(func(t *Task, res *Result, err error) { post = err })
+	c.AddFailureHook(func(t *Task, res *Result, err error) { failure = err })
+	err := cmd.runTask(task, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "Invalid mount no-destination") {
+		t.Fatalf("runTask returned %v, want an invalid mount error", err)
+	}
+
+	if ran {
+		t.Error("Task ran although it could not be prepared")
+	}
+
+	if post != err || failure != err {
+		t.Errorf("Hooks were given %v and %v, want %v", post, failure, err)
+	}
+}
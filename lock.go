@@ -0,0 +1,90 @@
+package cali
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fileLock is an advisory lock shared between invocations on the same host. It is held by locking a file
+// under ~/.<cli name>/locks with the OS, so it is released when the process exits, however it exits. Locks
+// are re-entrant within a process, as the OS would otherwise block a second lock of the same file forever
+type fileLock struct {
+	f     *os.File
+	path  string
+	holds int
+}
+
+var (
+	// heldLocks are the locks held by this process, by their paths
+	heldLocks   = make(map[string]*fileLock)
+	heldLocksMu sync.Mutex
+)
+
+// acquireLock blocks until it holds the lock called name
+func acquireLock(name string) (*fileLock, error) {
+	dir, err := dataDir("locks")
+
+	if err != nil {
+		return nil, err
+	}
+	return lockPath(filepath.Join(dir, name+".lock"))
+}
+
+// lockPath blocks until it holds the lock on the file at path, or returns the lock if this process already
+// holds it
+func lockPath(path string) (*fileLock, error) {
+	heldLocksMu.Lock()
+	l, held := heldLocks[path]
+
+	if held {
+		l.holds++
+	}
+	heldLocksMu.Unlock()
+
+	if held {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lock %s: %s", path, err)
+	}
+	ok, err := tryLockFile(f)
+
+	if err == nil && !ok {
+		log.Infof("Waiting for another invocation to finish with %s", filepath.Base(path))
+		err = lockFile(f)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to lock %s: %s", path, err)
+	}
+	l = &fileLock{f: f, path: path, holds: 1}
+	heldLocksMu.Lock()
+	heldLocks[path] = l
+	heldLocksMu.Unlock()
+	return l, nil
+}
+
+// Release releases the lock once it has been released as many times as it was acquired. The lock file is left
+// in place, as removing it would let another invocation lock a new file of the same name while a third still
+// waits on the old one
+func (l *fileLock) Release() {
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+
+	if l.holds--; l.holds > 0 {
+		return
+	}
+	delete(heldLocks, l.path)
+
+	if err := unlockFile(l.f); err != nil {
+		log.Warnf("Failed to release lock %s: %s", l.f.Name(), err)
+	}
+	l.f.Close()
+}
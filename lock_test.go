@@ -0,0 +1,52 @@
+package cali
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockPathReentrant(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkout.lock")
+	done := make(chan struct{})
+	var locks []*fileLock
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 2; i++ {
+			l, err := lockPath(path)
+
+			if err != nil {
+				t.Errorf("Failed to lock: %s", err)
+				return
+			}
+			locks = append(locks, l)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locking twice in one process blocked")
+	}
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i, l := range locks {
+		if ok, err := tryLockFile(f); err != nil || ok {
+			t.Fatalf("Lock was free after %d of %d releases: %v", i, len(locks), err)
+		}
+		l.Release()
+	}
+
+	if ok, err := tryLockFile(f); err != nil || !ok {
+		t.Errorf("Lock was held after every release: %v", err)
+	}
+	unlockFile(f)
+}
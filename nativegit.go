@@ -0,0 +1,451 @@
+package cali
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// NativeGit checks out repos in process into a cache directory on the host, which can then be bind
+// mounted into a task container. Unlike Git it needs no helper container, but it only works with a
+// Docker daemon which shares a filesystem with the host and does not support LFS or sparse checkouts
+type NativeGit struct {
+	// Dir is where checkouts are cached
+	Dir string
+	// Auth is used when talking to the remote. When nil it is chosen based on the repo URL
+	Auth transport.AuthMethod
+	// Progress receives progress output from the remote, if set
+	Progress io.Writer
+}
+
+// NewNativeGit returns a NativeGit which caches checkouts in ~/.<cli name>/git
+func NewNativeGit() (*NativeGit, error) {
+	dir, err := dataDir("git")
+
+	if err != nil {
+		return nil, err
+	}
+	return &NativeGit{Dir: dir, Progress: os.Stderr}, nil
+}
+
+// Checkout fetches the configured ref into a directory on the host and returns its path. The worktree is
+// reset and cleaned so that it exactly matches the ref
+func (n *NativeGit) Checkout(cfg *GitCheckoutConfig) (string, error) {
+	if cfg.LFS || cfg.sparse() {
+		return "", fmt.Errorf("LFS and sparse checkouts are not supported")
+	}
+	dir := filepath.Join(n.Dir, cfg.containerName())
+
+	if cfg.Fresh {
+		if err := os.RemoveAll(dir); err != nil {
+			return "", fmt.Errorf("Failed to remove %s: %s", dir, err)
+		}
+	}
+	repo, err := git.PlainOpen(dir)
+
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, false)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to open repo in %s: %s", dir, err)
+	}
+
+	if err := repo.DeleteRemote("origin"); err != nil && err != git.ErrRemoteNotFound {
+		return "", fmt.Errorf("Failed to remove remote: %s", err)
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{cfg.Repo}})
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to add remote: %s", err)
+	}
+	auth, err := n.auth(cfg.Repo)
+
+	if err != nil {
+		return "", err
+	}
+	hash, err := n.fetch(repo, remote, cfg, auth)
+
+	if err != nil {
+		return "", err
+	}
+	wt, err := repo.Worktree()
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to open worktree: %s", err)
+	}
+
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: hash, Force: true}); err != nil {
+		return "", fmt.Errorf("Failed to checkout %s: %s", hash, err)
+	}
+
+	if err := wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return "", fmt.Errorf("Failed to clean worktree: %s", err)
+	}
+
+	if cfg.Submodules {
+		subs, err := wt.Submodules()
+
+		if err != nil {
+			return "", fmt.Errorf("Failed to read submodules: %s", err)
+		}
+		opts := &git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		}
+
+		if err := subs.Update(opts); err != nil {
+			return "", fmt.Errorf("Failed to update submodules: %s", err)
+		}
+	}
+	return dir, nil
+}
+
+// Snapshot copies the checkout in dir into a new directory, so that a task can modify it without affecting
+// other invocations using the same checkout. The caller is responsible for removing it
+func (n *NativeGit) Snapshot(dir string) (string, error) {
+	root := filepath.Join(n.Dir, "snapshots")
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", fmt.Errorf("Failed to create %s: %s", root, err)
+	}
+	dst, err := ioutil.TempDir(root, filepath.Base(dir)+"_")
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create snapshot directory: %s", err)
+	}
+
+	if err := copyDir(dir, dst); err != nil {
+		os.RemoveAll(dst)
+		return "", fmt.Errorf("Failed to snapshot %s: %s", dir, err)
+	}
+	return dst, nil
+}
+
+// Push commits any changes in the checkout in dir and pushes them to a branch on origin, or prints the diff
+// if DryRun is set
+func (n *NativeGit) Push(dir string, cfg *GitPushConfig) error {
+	repo, err := git.PlainOpen(dir)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open repo in %s: %s", dir, err)
+	}
+	wt, err := repo.Worktree()
+
+	if err != nil {
+		return fmt.Errorf("Failed to open worktree: %s", err)
+	}
+	status, err := wt.Status()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get status of worktree: %s", err)
+	}
+
+	if status.IsClean() {
+		log.Info("No changes to push")
+		return nil
+	}
+
+	for path, s := range status {
+		if s.Worktree == git.Deleted {
+			_, err = wt.Remove(path)
+		} else {
+			_, err = wt.Add(path)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to stage %s: %s", path, err)
+		}
+	}
+	head, err := repo.Head()
+
+	if err != nil {
+		return fmt.Errorf("Failed to resolve HEAD: %s", err)
+	}
+	parent, err := repo.CommitObject(head.Hash())
+
+	if err != nil {
+		return fmt.Errorf("Failed to read commit %s: %s", head.Hash(), err)
+	}
+	name, email := cfg.author()
+	opts := &git.CommitOptions{
+		Author: &object.Signature{Name: name, Email: email, When: time.Now()},
+	}
+	hash, err := wt.Commit(cfg.message(), opts)
+
+	if err != nil {
+		return fmt.Errorf("Failed to commit: %s", err)
+	}
+
+	if cfg.DryRun {
+		commit, err := repo.CommitObject(hash)
+
+		if err != nil {
+			return fmt.Errorf("Failed to read commit %s: %s", hash, err)
+		}
+		patch, err := parent.Patch(commit)
+
+		if err != nil {
+			return fmt.Errorf("Failed to diff changes: %s", err)
+		}
+		fmt.Print(patch.Stats().String())
+		fmt.Print(patch.String())
+		// Leave the changes uncommitted, as they would be without a dry run
+		return wt.Reset(&git.ResetOptions{Commit: parent.Hash, Mode: git.MixedReset})
+	}
+	branch := plumbing.NewBranchReferenceName(cfg.Branch)
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		return fmt.Errorf("Failed to create branch %s: %s", cfg.Branch, err)
+	}
+	remote, err := repo.Remote("origin")
+
+	if err != nil {
+		return fmt.Errorf("Failed to find remote: %s", err)
+	}
+	auth, err := n.auth(remote.Config().URLs[0])
+
+	if err != nil {
+		return err
+	}
+	push := &git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", branch, branch))},
+		Auth:       auth,
+		Progress:   n.Progress,
+	}
+
+	if err := repo.Push(push); err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("Failed to push to %s: %s", cfg.Branch, err)
+	}
+	return nil
+}
+
+// Info returns metadata about the commit checked out in dir
+func (n *NativeGit) Info(dir string) (*GitInfo, error) {
+	repo, err := git.PlainOpen(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open repo in %s: %s", dir, err)
+	}
+	head, err := repo.Head()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve HEAD in %s: %s", dir, err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read commit %s: %s", head.Hash(), err)
+	}
+	return &GitInfo{
+		SHA:    head.Hash().String(),
+		Author: fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+	}, nil
+}
+
+// fetch fetches the configured ref from the remote and resolves it to a commit. Branches, tags and other
+// refs advertised by the remote are fetched on their own, otherwise the ref is assumed to be a commit SHA
+// and all branches and tags are fetched in order to find it
+func (n *NativeGit) fetch(repo *git.Repository, remote *git.Remote, cfg *GitCheckoutConfig, auth transport.AuthMethod) (plumbing.Hash, error) {
+	ref := cfg.ref()
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed to list refs of %s: %s", cfg.Repo, err)
+	}
+	src, dst := remoteRef(refs, ref)
+	opts := &git.FetchOptions{
+		Auth:     auth,
+		Progress: n.Progress,
+		Force:    true,
+		Tags:     git.NoTags,
+	}
+
+	if src != "" {
+		opts.Depth = cfg.depth()
+		opts.RefSpecs = []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", src, dst))}
+	} else {
+		opts.Tags = git.AllTags
+		opts.RefSpecs = []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	}
+
+	if err := repo.Fetch(opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, fmt.Errorf("Failed to fetch %s: %s", ref, err)
+	}
+
+	if src != "" {
+		hash, err := repo.ResolveRevision(plumbing.Revision(dst))
+
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("Failed to resolve %s: %s", ref, err)
+		}
+		return *hash, nil
+	}
+	return resolveCommit(repo, ref)
+}
+
+// auth returns the AuthMethod for a repo URL. HTTPS remotes use the token in $GIT_TOKEN, if set, and SSH
+// remotes use ssh-agent if it is running, falling back to the default keys in ~/.ssh
+func (n *NativeGit) auth(url string) (transport.AuthMethod, error) {
+	if n.Auth != nil {
+		return n.Auth, nil
+	}
+	ep, err := transport.NewEndpoint(url)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid git URL %s: %s", url, err)
+	}
+	user := ep.User
+
+	if user == "" {
+		user = "git"
+	}
+
+	switch ep.Protocol {
+	case "http", "https":
+		if token := os.Getenv("GIT_TOKEN"); token != "" {
+			return &http.BasicAuth{Username: user, Password: token}, nil
+		}
+	case "ssh":
+		if os.Getenv("SSH_AUTH_SOCK") != "" {
+			return ssh.NewSSHAgentAuth(user)
+		}
+		home, err := homeDir()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+			path := filepath.Join(home, ".ssh", key)
+
+			if _, err := os.Stat(path); err == nil {
+				return ssh.NewPublicKeysFromFile(user, path, "")
+			}
+		}
+	}
+	return nil, nil
+}
+
+// remoteRef finds ref amongst the refs advertised by a remote, trying it as a branch, a tag and then a full
+// ref name. It returns the matching remote ref and the local ref it should be fetched into, or empty strings
+// if there was no match
+func remoteRef(refs []*plumbing.Reference, ref string) (string, string) {
+	candidates := [][2]string{
+		{"refs/heads/" + ref, "refs/remotes/origin/" + ref},
+		{"refs/tags/" + ref, "refs/tags/" + ref},
+		{ref, ref},
+	}
+
+	for _, c := range candidates {
+		for _, r := range refs {
+			if r.Name().String() == c[0] {
+				return c[0], c[1]
+			}
+		}
+	}
+	return "", ""
+}
+
+// resolveCommit resolves a full or abbreviated commit SHA
+func resolveCommit(repo *git.Repository, sha string) (plumbing.Hash, error) {
+	if len(sha) == 40 {
+		hash := plumbing.NewHash(sha)
+
+		if _, err := repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("Failed to find commit %s: %s", sha, err)
+		}
+		return hash, nil
+	}
+	iter, err := repo.CommitObjects()
+
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed to list commits: %s", err)
+	}
+	var found []plumbing.Hash
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if strings.HasPrefix(c.Hash.String(), sha) {
+			found = append(found, c.Hash)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed to list commits: %s", err)
+	}
+
+	switch len(found) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("Failed to find ref or commit %s", sha)
+	case 1:
+		return found[0], nil
+	default:
+		return plumbing.ZeroHash, fmt.Errorf("Commit SHA %s is ambiguous", sha)
+	}
+}
+
+// copyDir recursively copies the contents of src into dst, preserving file modes and symlinks
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+// copyFile copies the file src to dst, creating it with the given mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
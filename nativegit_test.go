@@ -0,0 +1,280 @@
+package cali
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testSignature is the author of commits made by tests
+var testSignature = &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()}
+
+// newBareRemote creates a bare repo whose master has two commits changing README, the first of which is
+// tagged v1. It returns the path of the repo and the SHAs of the commits, oldest first
+func newBareRemote(t *testing.T) (string, []string) {
+	t.Helper()
+	src, remote := t.TempDir(), t.TempDir()
+	repo, err := git.PlainInit(src, false)
+
+	if err != nil {
+		t.Fatalf("Failed to init repo: %s", err)
+	}
+	wt, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatalf("Failed to open worktree: %s", err)
+	}
+	var shas []string
+
+	for _, content := range []string{"one", "two"} {
+		if err := ioutil.WriteFile(filepath.Join(src, "README"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := wt.Add("README"); err != nil {
+			t.Fatalf("Failed to stage README: %s", err)
+		}
+		hash, err := wt.Commit(content, &git.CommitOptions{Author: testSignature})
+
+		if err != nil {
+			t.Fatalf("Failed to commit: %s", err)
+		}
+		shas = append(shas, hash.String())
+	}
+
+	if _, err := repo.CreateTag("v1", plumbingHash(t, repo, shas[0]), nil); err != nil {
+		t.Fatalf("Failed to tag: %s", err)
+	}
+
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatalf("Failed to init bare repo: %s", err)
+	}
+
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}}); err != nil {
+		t.Fatalf("Failed to add remote: %s", err)
+	}
+	push := &git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+	}
+
+	if err := repo.Push(push); err != nil {
+		t.Fatalf("Failed to push: %s", err)
+	}
+	return remote, shas
+}
+
+// plumbingHash resolves a SHA in repo
+func plumbingHash(t *testing.T, repo *git.Repository, sha string) plumbing.Hash {
+	t.Helper()
+	hash, err := repo.ResolveRevision(plumbing.Revision(sha))
+
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %s", sha, err)
+	}
+	return *hash
+}
+
+// readFile returns the contents of the file at path, failing the test if it cannot be read
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNativeGitCheckout(t *testing.T) {
+	remote, shas := newBareRemote(t)
+	tests := []struct {
+		name        string
+		cfg         GitCheckoutConfig
+		sha, readme string
+	}{
+		{"branch", GitCheckoutConfig{Branch: "master"}, shas[1], "two"},
+		{"tag", GitCheckoutConfig{Branch: "master", Ref: "v1"}, shas[0], "one"},
+		{"full SHA", GitCheckoutConfig{Ref: shas[0]}, shas[0], "one"},
+		{"short SHA", GitCheckoutConfig{Ref: shas[0][:7]}, shas[0], "one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &NativeGit{Dir: t.TempDir()}
+			cfg := tt.cfg
+			cfg.Repo = remote
+			dir, err := n.Checkout(&cfg)
+
+			if err != nil {
+				t.Fatalf("Checkout failed: %s", err)
+			}
+			info, err := n.Info(dir)
+
+			if err != nil {
+				t.Fatalf("Info failed: %s", err)
+			}
+
+			if info.SHA != tt.sha {
+				t.Errorf("Checked out %s, want %s", info.SHA, tt.sha)
+			}
+
+			if readme := readFile(t, filepath.Join(dir, "README")); readme != tt.readme {
+				t.Errorf("README is %q, want %q", readme, tt.readme)
+			}
+		})
+	}
+}
+
+func TestNativeGitCheckoutDiscardsChanges(t *testing.T) {
+	remote, _ := newBareRemote(t)
+	n := &NativeGit{Dir: t.TempDir()}
+	cfg := &GitCheckoutConfig{Repo: remote, Branch: "master"}
+	dir, err := n.Checkout(cfg)
+
+	if err != nil {
+		t.Fatalf("Checkout failed: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "untracked"), []byte("left behind"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.Checkout(cfg); err != nil {
+		t.Fatalf("Second checkout failed: %s", err)
+	}
+
+	if readme := readFile(t, filepath.Join(dir, "README")); readme != "two" {
+		t.Errorf("README is %q after refreshing, want %q", readme, "two")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "untracked")); !os.IsNotExist(err) {
+		t.Errorf("Untracked file was not cleaned: %v", err)
+	}
+}
+
+func TestNativeGitCheckoutDepth(t *testing.T) {
+	remote, shas := newBareRemote(t)
+	tests := []struct {
+		name    string
+		depth   int
+		history bool
+	}{
+		{"default", 0, false},
+		{"full", -1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &NativeGit{Dir: t.TempDir()}
+			dir, err := n.Checkout(&GitCheckoutConfig{Repo: remote, Branch: "master", Depth: tt.depth})
+
+			if err != nil {
+				t.Fatalf("Checkout failed: %s", err)
+			}
+			repo, err := git.PlainOpen(dir)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = repo.CommitObject(plumbing.NewHash(shas[0]))
+
+			if history := err == nil; history != tt.history {
+				t.Errorf("Parent commit fetched is %t, want %t", history, tt.history)
+			}
+		})
+	}
+}
+
+func TestNativeGitPush(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{"push", false},
+		{"dry run", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, shas := newBareRemote(t)
+			n := &NativeGit{Dir: t.TempDir()}
+			dir, err := n.Checkout(&GitCheckoutConfig{Repo: remote, Branch: "master"})
+
+			if err != nil {
+				t.Fatalf("Checkout failed: %s", err)
+			}
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("three"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &GitPushConfig{Branch: "changes", Message: "Task changes", Author: "Task <task@example.com>", DryRun: tt.dryRun}
+
+			if err := n.Push(dir, cfg); err != nil {
+				t.Fatalf("Push failed: %s", err)
+			}
+			repo, err := git.PlainOpen(remote)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := repo.Reference(plumbing.NewBranchReferenceName("changes"), true)
+
+			if tt.dryRun {
+				if err == nil {
+					t.Errorf("Dry run pushed %s", ref.Hash())
+				}
+
+				if readme := readFile(t, filepath.Join(dir, "README")); readme != "three" {
+					t.Errorf("Dry run left README as %q, want the uncommitted %q", readme, "three")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Branch was not pushed: %s", err)
+			}
+			commit, err := repo.CommitObject(ref.Hash())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if commit.Message != cfg.Message || commit.Author.Email != "task@example.com" {
+				t.Errorf("Pushed commit %q by %s, want %q by task@example.com", commit.Message, commit.Author.Email, cfg.Message)
+			}
+
+			if len(commit.ParentHashes) != 1 || commit.ParentHashes[0].String() != shas[1] {
+				t.Errorf("Pushed commit has parents %v, want %s", commit.ParentHashes, shas[1])
+			}
+
+			for name, want := range map[string]string{"README": "three", "new": "new"} {
+				f, err := commit.File(name)
+
+				if err != nil {
+					t.Errorf("Pushed commit is missing %s: %s", name, err)
+					continue
+				}
+
+				if got, _ := f.Contents(); got != want {
+					t.Errorf("Pushed %s is %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
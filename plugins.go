@@ -0,0 +1,141 @@
+package cali
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+)
+
+// discoverPlugins adds a command for every executable called <cli name>-<command> in ~/.<cli name>/plugins or
+// on the PATH. Commands which already exist take precedence, as do plugins found earlier in the search
+func (c *cli) discoverPlugins() {
+	var dirs []string
+
+	if home, err := homeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, "."+c.name, "plugins"))
+	}
+	dirs = append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+	prefix := c.name + "-"
+
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+
+		if err != nil {
+			continue
+		}
+
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name(), prefix) || !isExecutable(f) {
+				continue
+			}
+			name := strings.TrimPrefix(f.Name(), prefix)
+
+			if runtime.GOOS == "windows" {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+
+			if name == "" || c.hasCommand(name) {
+				continue
+			}
+			c.addPlugin(name, filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// addPlugin adds a command which runs the plugin at path. Global flags given before the plugin's name are
+// parsed, and everything after it is passed to the plugin, so it can have flags of its own
+func (c *cli) addPlugin(name, path string) {
+	log.Debugf("Found plugin %s: %s", name, path)
+	cmd := newCommand(name)
+	cmd.plugin = path
+	cmd.SetShort(fmt.Sprintf("Plugin provided by %s", path))
+	cmd.cobra.DisableFlagParsing = true
+	cmd.cobra.RunE = func(cc *cobra.Command, _ []string) error {
+		args, err := c.pluginArgs(name, os.Args[1:])
+
+		if err != nil {
+			return err
+		}
+		c.applyGlobalFlags(cc, args)
+		cc.SilenceUsage = true
+		started := time.Now()
+		err = runPlugin(path, args)
+		e := c.historyEntry(nil, nil, err, c.runningFlags())
+		e.Command = c.name + " " + name
+		saveHistory(e, started)
+		return err
+	}
+	c.cmds[name] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
+
+// pluginArgs parses the global flags in args, the command line, up to the name of the plugin and returns the
+// arguments which follow it. A -- straight after the name is dropped, as it used to be needed before them
+func (c *cli) pluginArgs(name string, args []string) ([]string, error) {
+	flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flags.AddFlagSet(c.cobra.PersistentFlags())
+	flags.SetInterspersed(false)
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	args = flags.Args()
+
+	if len(args) == 0 || args[0] != name {
+		return nil, fmt.Errorf("Global flags must come before the plugin %s", name)
+	}
+	args = args[1:]
+
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return args, nil
+}
+
+// runPlugin runs the plugin at path, passing it the global flags as environment variables
+func runPlugin(path string, args []string) error {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), pluginEnvs()...)
+	return cmd.Run()
+}
+
+// pluginEnvs returns the resolved global flags as environment variables for plugins
+func pluginEnvs() []string {
+	return []string{
+		"CALI_CLI_NAME=" + cliName,
+		"CALI_CONFIG=" + myFlags.ConfigFileUsed(),
+		"CALI_DOCKER_HOST=" + dockerHost,
+		"CALI_DEBUG=" + strconv.FormatBool(debug),
+		"CALI_JSON=" + strconv.FormatBool(jsonLogs),
+		"CALI_NON_INTERACTIVE=" + strconv.FormatBool(nonInteractive),
+		"CALI_GIT_REPO=" + gitCfg.Repo,
+		"CALI_GIT_BRANCH=" + gitCfg.Branch,
+		"CALI_GIT_REF=" + gitCfg.Ref,
+		"CALI_GIT_PATH=" + gitCfg.RelPath,
+	}
+}
+
+// isExecutable determines if a file can be run as a plugin
+func isExecutable(f os.FileInfo) bool {
+	if f.IsDir() {
+		return false
+	}
+
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(f.Name()), ".exe")
+	}
+	return f.Mode()&0111 != 0
+}
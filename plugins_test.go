@@ -0,0 +1,40 @@
+package cali
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPluginArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args, want []string
+		debug      bool
+	}{
+		{"plugin flags", []string{"hello", "--name", "x"}, []string{"--name", "x"}, false},
+		{"global flags first", []string{"--debug", "hello", "--name", "x", "--debug"}, []string{"--name", "x", "--debug"}, true},
+		{"flag value named like the plugin", []string{"-b", "hello", "hello", "-b"}, []string{"-b"}, false},
+		{"after --", []string{"hello", "--", "--name", "x"}, []string{"--name", "x"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cli("test")
+			c.initFlags()
+			defer func() { debug = false }()
+			args, err := c.pluginArgs("hello", tt.args)
+
+			if err != nil {
+				t.Fatalf("Failed to parse args: %s", err)
+			}
+
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("Plugin args are %q, want %q", args, tt.want)
+			}
+
+			if debug != tt.debug {
+				t.Errorf("debug is %t, want %t", debug, tt.debug)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package cali
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+)
+
+// shellEntrypoint starts bash if the image has it, otherwise sh
+var shellEntrypoint = []string{"/bin/sh", "-c", "command -v bash >/dev/null && exec bash || exec sh"}
+
+// addShell adds the shell command, which opens an interactive shell in the image of another command with
+// the same mounts, environment, workdir and git checkout the command would run with
+func (c *cli) addShell() {
+	if c.hasCommand("shell") {
+		return
+	}
+	cmd := newCommand("shell")
+	cmd.cobra.Use = "shell <command> [flags]"
+	cmd.SetShort("Open a shell in the container a command would run in")
+	cmd.SetLong(fmt.Sprintf(`Open an interactive shell in the container a command would run in, with the same mounts,
+environment, workdir and git checkout, but with the entrypoint and command overridden. Flags are those of
+the command, e.g.
+
+  %s shell terraform --git git@github.com:someone/terraform_code.git`, c.name))
+	// Flags belong to the target command, so are parsed once it has been found
+	cmd.cobra.DisableFlagParsing = true
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		target, err := c.findTarget(args)
+
+		if err != nil {
+			return err
+		}
+		cc.SilenceUsage = true
+		started := time.Now()
+		t, res, err := target.shell()
+
+		if t != nil {
+			e := c.historyEntry(t, res, err, target.cobra.Flags())
+			e.Command = fmt.Sprintf("%s shell %s", c.name, strings.TrimPrefix(target.path(), c.name+" "))
+			saveHistory(e, started)
+		}
+		return err
+	}
+	c.cmds["shell"] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
+
+// findTarget finds the command a shell is opened for and parses its flags from args
+func (c *cli) findTarget(args []string) (*command, error) {
+	found, rest, err := c.cobra.Find(args)
+
+	if err != nil {
+		return nil, err
+	}
+	target := c.findCommand(found)
+
+	if target == nil || target == c.command {
+		return nil, fmt.Errorf("A command with a Task is needed, e.g. %s shell <command>", c.name)
+	}
+
+	if err := found.ParseFlags(rest); err != nil {
+		if err == flag.ErrHelp {
+			found.Help()
+		}
+		return nil, err
+	}
+	c.applyGlobalFlags(found, found.Flags().Args())
+	return target, nil
+}
+
+// applyGlobalFlags puts the global flags into effect for commands which parse flags themselves, as the config
+// file, profile, debug and json flags are used before the command runs
+func (c *cli) applyGlobalFlags(cc *cobra.Command, args []string) {
+	c.readConfigFlags()
+	c.cobra.PersistentPreRun(cc, args)
+}
+
+// findCommand returns the command wrapping cc, or nil if there is none
+func (c *command) findCommand(cc *cobra.Command) *command {
+	if c.cobra == cc {
+		return c
+	}
+
+	for _, child := range c.children {
+		if cmd := child.findCommand(cc); cmd != nil {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// shell prepares the command's Task as if it were run, then runs a shell in its image instead. The Task and
+// the Result of the shell are returned for the history, unless the command has no image
+func (c *command) shell() (*Task, *Result, error) {
+	c.bindConfig()
+
+	if err := c.initTask(nil); err != nil {
+		return c.task(), nil, err
+	}
+	t := c.task()
+
+	if t == nil || t.Conf.Image == "" {
+		return nil, nil, fmt.Errorf("Command %s has no image to open a shell in", c.path())
+	}
+
+	defer t.Cleanup()
+
+	if err := t.SetDefaults(nil); err != nil {
+		return t, nil, fmt.Errorf("Error setting container defaults: %s", err)
+	}
+
+	if err := t.InitDocker(); err != nil {
+		return t, nil, fmt.Errorf("Error initialising Docker: %s", err)
+	}
+	t.Conf.Entrypoint = shellEntrypoint
+	t.Conf.Cmd = nil
+	res, err := t.RunContainer(true, "")
+
+	if _, ok := err.(*ExitError); ok {
+		// The exit status of the last command run in the shell is not an error
+		return t, res, nil
+	}
+	return t, res, err
+}
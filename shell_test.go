@@ -0,0 +1,48 @@
+package cali
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellConfigProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "profiles:\n  prod:\n    terraform:\n      tag: 0.10.0\n"
+
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"before command", []string{"--config", path, "--config-profile", "prod", "terraform"}},
+		{"after command", []string{"terraform", "--config", path, "--config-profile", "prod"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cli("test")
+			c.initFlags()
+			c.Command("terraform").Task("hashicorp/terraform:0.9.9")
+			defer func() { configProfile = "" }()
+			// As cobra does before running shell, whose flags are not parsed
+			c.initConfig()
+			target, err := c.findTarget(tt.args)
+
+			if err != nil {
+				t.Fatalf("Failed to find target: %s", err)
+			}
+			target.bindConfig()
+
+			if err := target.initTask(nil); err != nil {
+				t.Fatalf("Failed to prepare task: %s", err)
+			}
+
+			if image := target.task().Conf.Image; image != "hashicorp/terraform:0.10.0" {
+				t.Errorf("Image is %s, want hashicorp/terraform:0.10.0 from the profile", image)
+			}
+		})
+	}
+}
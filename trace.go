@@ -0,0 +1,173 @@
+package cali
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+const tracerName = "github.com/adampointer/cali"
+
+var (
+	traceEndpoint, traceFile string
+	// tracer creates spans, and does nothing until tracing is enabled
+	tracer         = otel.Tracer(tracerName)
+	tracerProvider *sdktrace.TracerProvider
+	timings        *timingProcessor
+)
+
+// initTracing exports spans over OTLP to --trace-endpoint (or OTEL_EXPORTER_OTLP_ENDPOINT) and to
+// --trace-file if set, and collects them for a timing breakdown in debug mode
+func initTracing() error {
+	if tracerProvider != nil {
+		return nil
+	}
+	otlp := traceEndpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+
+	if !otlp && traceFile == "" && !debug {
+		return nil
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", cliName))
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	if otlp {
+		var expOpts []otlptracehttp.Option
+
+		if traceEndpoint != "" {
+			expOpts = append(expOpts, otlptracehttp.WithEndpointURL(traceEndpoint))
+		}
+		exp, err := otlptracehttp.New(context.Background(), expOpts...)
+
+		if err != nil {
+			return fmt.Errorf("Error creating OTLP exporter: %s", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	if traceFile != "" {
+		f, err := os.OpenFile(traceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+		if err != nil {
+			return fmt.Errorf("Error opening trace file: %s", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+
+		if err != nil {
+			return fmt.Errorf("Error creating trace file exporter: %s", err)
+		}
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	}
+
+	if debug {
+		timings = new(timingProcessor)
+		opts = append(opts, sdktrace.WithSpanProcessor(timings))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(opts...)
+	tracer = tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+// shutdownTracing flushes any spans still to be exported, and prints the timing breakdown in debug mode
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Warnf("Error exporting traces: %s", err)
+	}
+
+	if timings != nil {
+		timings.print()
+	}
+}
+
+// span is a span which can only be ended once, along with the context holding it for starting its children
+type span struct {
+	trace.Span
+	ctx   context.Context
+	ended bool
+}
+
+// startSpan starts a span as a child of the span in ctx, if any
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) *span {
+	ctx, s := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return &span{Span: s, ctx: ctx}
+}
+
+// end ends the span, recording err if it is not nil. Ending it again does nothing
+func (s *span) end(err error) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+// timingProcessor collects ended spans for the timing breakdown
+type timingProcessor struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+// OnStart implements sdktrace.SpanProcessor
+func (p *timingProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+// OnEnd implements sdktrace.SpanProcessor
+func (p *timingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.spans = append(p.spans, s)
+}
+
+// Shutdown implements sdktrace.SpanProcessor
+func (p *timingProcessor) Shutdown(context.Context) error { return nil }
+
+// ForceFlush implements sdktrace.SpanProcessor
+func (p *timingProcessor) ForceFlush(context.Context) error { return nil }
+
+// print logs how long each span took, indented beneath its parent, in the order they started
+func (p *timingProcessor) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	spans := append([]sdktrace.ReadOnlySpan(nil), p.spans...)
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].StartTime().Before(spans[j].StartTime())
+	})
+	depths := make(map[trace.SpanID]int)
+
+	for _, s := range spans {
+		depth := 0
+
+		if parent := s.Parent(); parent.IsValid() {
+			if d, ok := depths[parent.SpanID()]; ok {
+				depth = d + 1
+			}
+		}
+		depths[s.SpanContext().SpanID()] = depth
+		log.Debugf("%s%-*s %s", strings.Repeat("  ", depth), 30-2*depth, s.Name(),
+			s.EndTime().Sub(s.StartTime()).Round(time.Millisecond))
+	}
+}
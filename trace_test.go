@@ -0,0 +1,115 @@
+package cali
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sends spans to a recorder for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer(tracerName)
+	t.Cleanup(func() { tracer = otel.Tracer(tracerName) })
+	return rec
+}
+
+// endedSpan returns the ended span called name
+func endedSpan(t *testing.T, rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	t.Fatalf("No span called %s", name)
+	return nil
+}
+
+func TestRunTaskSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		res      *Result
+		err      error
+		status   codes.Code
+		exitCode int64
+	}{
+		{"success", &Result{}, nil, codes.Unset, 0},
+		{"non-zero exit", &Result{ExitCode: 3}, &ExitError{Code: 3}, codes.Error, 3},
+		{"interrupted", &Result{}, ErrInterrupted, codes.Error, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recordSpans(t)
+			c := Cli("test")
+			cmd := c.Command("terraform")
+			task := cmd.Task(RunFunc(func(t *Task, args []string) (*Result, error) {
+				startSpan(t.traceContext(), "child").end(nil)
+				return tt.res, tt.err
+			}))
+
+			if err := cmd.runTask(task, nil); err != tt.err {
+				t.Fatalf("runTask returned %v, want %v", err, tt.err)
+			}
+			parent := endedSpan(t, rec, "test terraform")
+
+			if parent.Status().Code != tt.status {
+				t.Errorf("Status is %s, want %s", parent.Status().Code, tt.status)
+			}
+			var exitCode attribute.Value
+
+			for _, a := range parent.Attributes() {
+				if a.Key == "exit_code" {
+					exitCode = a.Value
+				}
+			}
+
+			if exitCode.AsInt64() != tt.exitCode {
+				t.Errorf("exit_code is %d, want %d", exitCode.AsInt64(), tt.exitCode)
+			}
+
+			if child := endedSpan(t, rec, "child"); child.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("Child span is not nested under the task's span")
+			}
+		})
+	}
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		received <- r.URL.Path
+	}))
+	defer srv.Close()
+	traceEndpoint = srv.URL
+	defer func() {
+		traceEndpoint = ""
+		tracerProvider = nil
+		tracer = otel.Tracer(tracerName)
+	}()
+
+	if err := initTracing(); err != nil {
+		t.Fatal(err)
+	}
+	startSpan(t.Context(), "task").end(nil)
+	shutdownTracing()
+
+	select {
+	case path := <-received:
+		if path != "/v1/traces" {
+			t.Errorf("Spans exported to %s, want /v1/traces", path)
+		}
+	default:
+		t.Error("No spans were exported")
+	}
+}
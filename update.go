@@ -0,0 +1,288 @@
+package cali
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Release is the JSON served by a release feed, e.g.
+//
+//	{
+//	  "version": "1.2.0",
+//	  "binaries": {
+//	    "linux-amd64": {
+//	      "url": "https://example.com/mycli/1.2.0/mycli-linux-amd64",
+//	      "sha256": "<hex encoded SHA-256 of the binary>",
+//	      "signature": "<base64 encoded ed25519 signature, see ReleaseBinary.Message>"
+//	    }
+//	  }
+//	}
+type Release struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]ReleaseBinary `json:"binaries"`
+}
+
+// ReleaseBinary is the binary released for a single platform
+type ReleaseBinary struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Message returns what is signed for the binary released as version for platform (e.g. linux-amd64). The version
+// and platform are signed along with the checksum, so that a feed cannot pass off an old binary as a new release
+func (b ReleaseBinary) Message(version, platform string) []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n", version, platform, strings.ToLower(b.SHA256)))
+}
+
+// updater replaces the running binary with the latest release from a feed
+type updater struct {
+	feedURL, version, exe string
+	key                   ed25519.PublicKey
+	client                *http.Client
+}
+
+// SetVersion sets the version of the cli, which is shown by --version and used by the update command
+func (c *cli) SetVersion(v string) {
+	c.version = v
+	c.cobra.Version = v
+}
+
+// EnableUpdate adds an update command which replaces the running binary with the latest release from the feed at
+// feedURL (see Release). Binaries must be signed with the ed25519 private key matching publicKey, which is base64
+// encoded and typically embedded at build time, e.g. with -ldflags "-X main.publicKey=...". SetVersion must also
+// be called so that releases can be compared with the running version
+func (c *cli) EnableUpdate(feedURL, publicKey string) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		// As with Task, this is an implementation error rather than a runtime error
+		fmt.Println("Invalid update public key. Must be a base64 encoded ed25519 public key")
+		os.Exit(EXIT_CODE_API_ERROR)
+	}
+	var check bool
+	cmd := newCommand("update")
+	cmd.SetShort(fmt.Sprintf("Update %s to the latest version", c.name))
+	cmd.Flags().BoolVar(&check, "check", false, "Only check whether an update is available")
+	cmd.cobra.RunE = func(cc *cobra.Command, args []string) error {
+		cc.SilenceUsage = true
+		exe, err := runningExecutable()
+
+		if err != nil {
+			return fmt.Errorf("Error updating: %s", err)
+		}
+		u := &updater{
+			feedURL: feedURL,
+			version: c.version,
+			exe:     exe,
+			key:     ed25519.PublicKey(key),
+			client:  &http.Client{Timeout: 5 * time.Minute},
+		}
+
+		if err := u.run(check); err != nil {
+			return fmt.Errorf("Error updating: %s", err)
+		}
+		return nil
+	}
+	c.cmds["update"] = cmd
+	c.cobra.AddCommand(cmd.cobra)
+}
+
+// runningExecutable returns the path of the running binary, with any symlinks resolved
+func runningExecutable() (string, error) {
+	exe, err := os.Executable()
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to find running executable: %s", err)
+	}
+
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", fmt.Errorf("Failed to find running executable: %s", err)
+	}
+	return exe, nil
+}
+
+// run updates the binary if a newer release is available, or just reports on it if check is set
+func (u *updater) run(check bool) error {
+	if u.version == "" {
+		return fmt.Errorf("The running version is unknown, so cannot be compared with releases. SetVersion must be called")
+	}
+	rel, err := u.latest()
+
+	if err != nil {
+		return err
+	}
+
+	if compareVersions(rel.Version, u.version) <= 0 {
+		log.Infof("Already up to date at version %s", u.version)
+		return nil
+	}
+
+	if check {
+		log.Infof("Version %s is available, currently at %s", rel.Version, u.version)
+		return nil
+	}
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	bin, ok := rel.Binaries[platform]
+
+	if !ok {
+		return fmt.Errorf("Version %s has no binary for %s", rel.Version, platform)
+	}
+	sig, err := base64.StdEncoding.DecodeString(bin.Signature)
+
+	if err != nil || !ed25519.Verify(u.key, bin.Message(rel.Version, platform), sig) {
+		return fmt.Errorf("Invalid signature for version %s on %s", rel.Version, platform)
+	}
+	log.Infof("Downloading version %s", rel.Version)
+	data, err := u.download(bin)
+
+	if err != nil {
+		return err
+	}
+
+	if err := replaceExecutable(u.exe, data); err != nil {
+		return err
+	}
+	log.Infof("Updated from version %s to %s", u.version, rel.Version)
+	return nil
+}
+
+// latest fetches the latest release from the feed
+func (u *updater) latest() (*Release, error) {
+	resp, err := u.client.Get(u.feedURL)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch release feed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch release feed: %s", resp.Status)
+	}
+	rel := new(Release)
+
+	if err := json.NewDecoder(resp.Body).Decode(rel); err != nil {
+		return nil, fmt.Errorf("Error decoding release feed: %s", err)
+	}
+	return rel, nil
+}
+
+// download fetches a binary and verifies its checksum, which is covered by the signature checked by run
+func (u *updater) download(bin ReleaseBinary) ([]byte, error) {
+	resp, err := u.client.Get(bin.URL)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download %s: %s", bin.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download %s: %s", bin.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download %s: %s", bin.URL, err)
+	}
+	sum := sha256.Sum256(data)
+	want, err := hex.DecodeString(bin.SHA256)
+
+	if err != nil || !bytes.Equal(sum[:], want) {
+		return nil, fmt.Errorf("Checksum mismatch for %s", bin.URL)
+	}
+	return data, nil
+}
+
+// replaceExecutable atomically replaces the executable at exe with data, by writing it alongside and renaming
+// it into place. Windows will not replace a running executable, so it is moved out of the way first, and moved
+// back if the new one cannot be put in its place
+func replaceExecutable(exe string, data []byte) error {
+	dir, base := filepath.Split(exe)
+	tmp := filepath.Join(dir, "."+base+".new")
+
+	if err := ioutil.WriteFile(tmp, data, 0755); err != nil {
+		return fmt.Errorf("Failed to write new executable: %s", err)
+	}
+
+	var old string
+
+	if runtime.GOOS == "windows" {
+		old = filepath.Join(dir, "."+base+".old")
+		os.Remove(old)
+
+		if err := os.Rename(exe, old); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("Failed to move old executable: %s", err)
+		}
+	}
+
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+
+		if old != "" {
+			if rerr := os.Rename(old, exe); rerr != nil {
+				return fmt.Errorf("Failed to replace executable: %s. The old executable is at %s: %s", err, old, rerr)
+			}
+		}
+		return fmt.Errorf("Failed to replace executable: %s", err)
+	}
+	return nil
+}
+
+// compareVersions compares two dotted version numbers, optionally prefixed with v, returning -1, 0 or 1 if a is
+// older, the same as or newer than b. Anything after a - or + is ignored
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+
+		if i < len(pa) {
+			x = pa[i]
+		}
+
+		if i < len(pb) {
+			y = pb[i]
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionParts splits a version number into its numeric parts
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,112 @@
+package cali
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testFeed serves a release feed for the current platform, with the binary at /bin
+type testFeed struct {
+	version, signedVersion string
+	bin, signedBin         []byte
+	key                    ed25519.PrivateKey
+}
+
+func (f *testFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/bin" {
+		w.Write(f.bin)
+		return
+	}
+	sum := sha256.Sum256(f.signedBin)
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	bin := ReleaseBinary{URL: "http://" + r.Host + "/bin", SHA256: hex.EncodeToString(sum[:])}
+	bin.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(f.key, bin.Message(f.signedVersion, platform)))
+	json.NewEncoder(w).Encode(&Release{Version: f.version, Binaries: map[string]ReleaseBinary{platform: bin}})
+}
+
+func TestUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBin, oldBin := []byte("new binary"), []byte("old vulnerable binary")
+	tests := []struct {
+		name    string
+		version string
+		feed    testFeed
+		want    []byte
+		wantErr bool
+	}{
+		{"newer", "1.1.0", testFeed{"1.2.0", "1.2.0", newBin, newBin, priv}, newBin, false},
+		{"same version", "1.2.0", testFeed{"1.2.0", "1.2.0", newBin, newBin, priv}, nil, false},
+		{"older", "1.3.0", testFeed{"1.2.0", "1.2.0", newBin, newBin, priv}, nil, false},
+		{"bad signature", "1.1.0", testFeed{"1.2.0", "1.2.0", newBin, newBin, otherKey}, nil, true},
+		{"old binary relabelled", "1.1.0", testFeed{"1.2.0", "1.0.0", oldBin, oldBin, priv}, nil, true},
+		{"binary swapped", "1.1.0", testFeed{"1.2.0", "1.2.0", oldBin, newBin, priv}, nil, true},
+		{"unknown version", "", testFeed{"1.2.0", "1.2.0", newBin, newBin, priv}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := tt.feed
+			srv := httptest.NewServer(&feed)
+			defer srv.Close()
+			exe := filepath.Join(t.TempDir(), "mycli")
+			current := []byte("current binary")
+
+			if err := ioutil.WriteFile(exe, current, 0755); err != nil {
+				t.Fatal(err)
+			}
+			u := &updater{feedURL: srv.URL, version: tt.version, exe: exe, key: pub, client: srv.Client()}
+			err := u.run(false)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update returned %v, want error %t", err, tt.wantErr)
+			}
+			want := tt.want
+
+			if want == nil {
+				want = current
+			}
+
+			if got := readFile(t, exe); got != string(want) {
+				t.Errorf("Executable is %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"v1.2", "1.2.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2.0-rc1", "1.2.1", -1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
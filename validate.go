@@ -0,0 +1,157 @@
+package cali
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	flag "github.com/spf13/pflag"
+)
+
+// ValidationError lists every problem found with the definition of a cli
+type ValidationError struct {
+	Problems []string
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid CLI definition:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// TB is the part of testing.TB used by AssertValid
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Validate checks the whole command tree, returning a ValidationError listing every problem found. Every
+// command must have a Task, or nested commands, or a parent with a Task. Images, including those set in
+// config, must be valid references and flags must not redefine those of parent commands, including the
+// global flags. Commands added by the cli itself, such as doctor, and plugins are checked against the global
+// flags too. Start validates the cli before running it, and again once config has been read
+func (c *cli) Validate() error {
+	c.initFlags()
+	var problems []string
+
+	for _, cmd := range c.children {
+		problems = append(problems, cmd.validate(c.command)...)
+	}
+	var builtins []string
+
+	for name, cmd := range c.cmds {
+		if cmd.parent == nil {
+			builtins = append(builtins, name)
+		}
+	}
+	sort.Strings(builtins)
+
+	for _, name := range builtins {
+		problems = append(problems, c.cmds[name].validate(c.command)...)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// AssertValid reports any problems found by Validate as test errors, e.g.
+//
+//	func TestCli(t *testing.T) {
+//		newCli().AssertValid(t)
+//	}
+func (c *cli) AssertValid(t TB) {
+	t.Helper()
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+// validate checks the command and those nested under it. A command without a parent was added by the cli itself
+// rather than nested under root, so runs its own func rather than a Task, but shares the global flags of root
+func (c *command) validate(root *command) []string {
+	var problems []string
+	path := c.path()
+	parent := c.parent
+
+	if parent == nil {
+		parent = root
+	} else if c.task() == nil && len(c.children) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: no Task for the command or its parents", path))
+	}
+
+	if t := c.RunTask; t != nil {
+		if t.f == nil {
+			problems = append(problems, fmt.Sprintf("%s: Task has no func", path))
+		}
+		img := t.Conf.Image
+
+		if img == "" && t.runsImage && myFlags.GetString(c.configKey("image")) == "" {
+			problems = append(problems, fmt.Sprintf("%s: Task has no image", path))
+		}
+
+		if img != "" {
+			if _, err := reference.ParseNormalizedNamed(img); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid image %s: %s", path, img, err))
+			}
+		}
+	}
+
+	if c.parent != nil {
+		if img := myFlags.GetString(c.configKey("image")); img != "" {
+			if _, err := reference.ParseNormalizedNamed(img); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid image %s in config: %s", path, img, err))
+			}
+		}
+
+		if tag := myFlags.GetString(c.configKey("tag")); tag != "" && !tagPattern.MatchString(tag) {
+			problems = append(problems, fmt.Sprintf("%s: invalid tag %s in config", path, tag))
+		}
+	}
+	c.visitOwnFlags(func(f *flag.Flag) {
+		for p := parent; p != nil; p = p.parent {
+			if existing := p.Flags().Lookup(f.Name); existing != nil && existing != f {
+				problems = append(problems, fmt.Sprintf("%s: flag --%s redefines a flag of %s", path, f.Name, p.path()))
+			}
+
+			if f.Shorthand == "" {
+				continue
+			}
+
+			if existing := p.Flags().ShorthandLookup(f.Shorthand); existing != nil && existing != f {
+				problems = append(problems, fmt.Sprintf("%s: shorthand -%s of --%s is already used by --%s of %s",
+					path, f.Shorthand, f.Name, existing.Name, p.path()))
+			}
+		}
+	})
+
+	for _, cmd := range c.children {
+		problems = append(problems, cmd.validate(root)...)
+	}
+	return problems
+}
+
+// visitOwnFlags calls fn for each persistent and local flag defined by the command, but not those it inherits
+func (c *command) visitOwnFlags(fn func(*flag.Flag)) {
+	seen := make(map[*flag.Flag]bool)
+	visit := func(f *flag.Flag) {
+		if !seen[f] {
+			seen[f] = true
+			fn(f)
+		}
+	}
+	c.cobra.PersistentFlags().VisitAll(visit)
+	c.cobra.Flags().VisitAll(visit)
+}
+
+// path returns the names of the command and its parents, e.g. cali aws login
+func (c *command) path() string {
+	var names []string
+
+	for _, cmd := range c.lineage() {
+		names = append(names, cmd.cobra.Name())
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,71 @@
+package cali
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recorder is a TB which records the errors reported to it
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		define  func(c *cli)
+		problem string
+	}{
+		{"valid", func(c *cli) {
+			aws := c.Command("aws")
+			aws.Task("mesosphere/aws-cli")
+			aws.Flags().StringP("profile", "p", "default", "")
+			aws.Command("login").Flags().StringP("region", "r", "", "")
+		}, ""},
+		{"duplicate shorthand", func(c *cli) {
+			aws := c.Command("aws")
+			aws.Task("mesosphere/aws-cli")
+			aws.Flags().StringP("profile", "p", "default", "")
+			aws.Command("login").Flags().StringP("partition", "p", "", "")
+		}, "shorthand -p of --partition is already used by --profile of test aws"},
+		{"shorthand of a built in command", func(c *cli) {
+			c.Flags().StringP("organisation", "o", "", "")
+			c.Command("terraform").Task("hashicorp/terraform")
+			c.addDoctor()
+		}, "doctor: shorthand -o of --output is already used by --organisation of test"},
+		{"empty image", func(c *cli) {
+			c.Command("terraform").Task("")
+		}, "test terraform: Task has no image"},
+		{"invalid image in config", func(c *cli) {
+			c.Command("terraform").Task("hashicorp/terraform")
+			myFlags.Set("terraform.image", "Hashicorp/Terraform")
+		}, "test terraform: invalid image Hashicorp/Terraform in config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cli("test")
+			tt.define(c)
+			r := new(recorder)
+			c.AssertValid(r)
+
+			if tt.problem == "" {
+				if len(r.errors) > 0 {
+					t.Errorf("Valid cli reported %s", r.errors)
+				}
+				return
+			}
+
+			if len(r.errors) != 1 || !strings.Contains(r.errors[0], tt.problem) {
+				t.Errorf("Reported %q, want %q", r.errors, tt.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package cali
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"golang.org/x/net/context"
+)
+
+const (
+	// CleanWorkspaceHead copies only what is committed at HEAD into a clean workspace
+	CleanWorkspaceHead = "head"
+	// CleanWorkspaceChanges also copies staged, unstaged and untracked changes into a clean workspace
+	CleanWorkspaceChanges = "changes"
+)
+
+// BindCleanWorkspace copies the git repo at dir into the volume of a fresh data container and mounts it at
+// /tmp/workspace, rather than binding the working tree directly. Ignored files are never copied. Depending on
+// mode, either only HEAD (CleanWorkspaceHead) or HEAD plus any changes (CleanWorkspaceChanges) are copied
+func (c *DockerClient) BindCleanWorkspace(dir, mode string) error {
+	if mode != CleanWorkspaceHead && mode != CleanWorkspaceChanges {
+		return fmt.Errorf("Unknown --clean-workspace mode %s, must be %s or %s", mode, CleanWorkspaceHead, CleanWorkspaceChanges)
+	}
+	info, err := LocalGitInfo(dir)
+
+	if err != nil {
+		return fmt.Errorf("A clean workspace needs a git repo: %s", err)
+	}
+
+	if mode == CleanWorkspaceHead {
+		info.Dirty = false
+	}
+	cli := NewDockerClient()
+	cli.ctx = c.ctx
+
+	if err := cli.InitDocker(); err != nil {
+		return err
+	}
+	cli.SetConf(&container.Config{
+		Image:  gitImage,
+		Cmd:    []string{"true"},
+		Labels: map[string]string{labelCli: cliName, labelTemporary: "true"},
+	})
+	cli.SetHostConf(&container.HostConfig{Binds: []string{workdir}})
+	cli.SetNetConf(&network.NetworkingConfig{})
+
+	if err := cli.PullImage(gitImage); err != nil {
+		return fmt.Errorf("Failed to fetch image: %s", err)
+	}
+	resp, err := cli.Cli.ContainerCreate(context.Background(), cli.Conf, cli.HostConf, cli.NetConf, "")
+
+	if err != nil {
+		return fmt.Errorf("Failed to create workspace container: %s", err)
+	}
+	c.cleanups = append(c.cleanups, func() error {
+		opts := types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}
+
+		if err := cli.Cli.ContainerRemove(context.Background(), resp.ID, opts); err != nil {
+			return fmt.Errorf("Failed to remove workspace container: %s", err)
+		}
+		return nil
+	})
+	log.WithFields(log.Fields{
+		"dir":    dir,
+		"mode":   mode,
+		"commit": info.SHA,
+	}).Info("Copying clean workspace")
+
+	archive := workspaceArchive(dir, mode)
+	defer archive.Close()
+
+	if err := cli.Cli.CopyToContainer(context.Background(), resp.ID, workdir, archive, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("Failed to copy workspace: %s", err)
+	}
+	c.HostConf.VolumesFrom = append(c.HostConf.VolumesFrom, resp.ID)
+	c.GitInfo = info
+	return nil
+}
+
+// workspaceArchive streams a tar of the git repo at dir
+func workspaceArchive(dir, mode string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		if mode == CleanWorkspaceHead {
+			pw.CloseWithError(archiveHead(pw, dir))
+		} else {
+			pw.CloseWithError(archiveChanges(pw, dir))
+		}
+	}()
+	return pr
+}
+
+// archiveHead writes a tar of what is committed at HEAD under dir
+func archiveHead(w io.Writer, dir string) error {
+	prefix, err := hostGit(dir, "rev-parse", "--show-prefix")
+
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "archive", "--format=tar", "HEAD:"+prefix)
+	cmd.Dir = dir
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git archive failed: %s", err)
+	}
+	return nil
+}
+
+// archiveChanges writes a tar of the tracked and untracked files under dir as they are in the working tree,
+// excluding ignored files
+func archiveChanges(w io.Writer, dir string) error {
+	cmd := exec.Command("git", "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+
+	if err != nil {
+		return fmt.Errorf("git ls-files failed: %s", err)
+	}
+	tw := tar.NewWriter(w)
+
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Lstat(path)
+
+		if os.IsNotExist(err) {
+			// Deleted in the working tree
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Submodules are not copied
+			continue
+		}
+		var link string
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			if err := copyInto(tw, path); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// copyInto copies the contents of the file at path into w
+func copyInto(w io.Writer, path string) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}